@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"image"
+	_ "image/jpeg" //注册jpeg解码
+	_ "image/png"  //注册png解码
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	_ "golang.org/x/image/webp" //注册webp解码
+)
+
+// Blank tile actions
+const (
+	BlankDrop = "drop" //空白瓦片不保存
+	BlankMark = "mark" //空白瓦片照常保存, 仅记录
+)
+
+// BlankFilter 空白/占位瓦片识别, 源站以200返回的无数据图片按规则识别
+type BlankFilter struct {
+	Action    string
+	Hashes    map[string]bool //已知占位图片的md5
+	MinSize   int             //小于该字节数的瓦片视为空白
+	Solid     bool            //解码后为单一颜色或全透明的瓦片视为空白
+	Tolerance uint8           //单色判断时各通道允许的差值
+}
+
+// NewBlankFilter 从配置创建空白瓦片规则, 未配置任何规则时返回nil
+func NewBlankFilter() *BlankFilter {
+	f := &BlankFilter{
+		Action:    viper.GetString("task.blank.action"),
+		Hashes:    make(map[string]bool),
+		MinSize:   viper.GetInt("task.blank.minsize"),
+		Solid:     viper.GetBool("task.blank.solid"),
+		Tolerance: uint8(viper.GetInt("task.blank.tolerance")),
+	}
+	for _, h := range viper.GetStringSlice("task.blank.hashes") {
+		f.Hashes[strings.ToLower(strings.TrimSpace(h))] = true
+	}
+	if len(f.Hashes) == 0 && f.MinSize <= 0 && !f.Solid {
+		return nil
+	}
+	if f.Action != BlankMark {
+		if f.Action != BlankDrop {
+			log.Warnf("unknown blank action %q, use %s ~", f.Action, BlankDrop)
+		}
+		f.Action = BlankDrop
+	}
+	return f
+}
+
+// Check 返回瓦片被识别为空白的原因, 非空白时返回空字符串
+func (f *BlankFilter) Check(body []byte, format string) string {
+	if f == nil {
+		return ""
+	}
+	if len(f.Hashes) > 0 {
+		hash := fmt.Sprintf("%x", md5.Sum(body))
+		if f.Hashes[hash] {
+			return "hash " + hash
+		}
+	}
+	if len(body) < f.MinSize {
+		return fmt.Sprintf("size %d", len(body))
+	}
+	if f.Solid && format != PBF {
+		img, _, err := image.Decode(bytes.NewReader(body))
+		if err != nil {
+			log.Debugf("decode tile error ~ %s", err)
+			return ""
+		}
+		if solidImage(img, f.Tolerance) {
+			return "solid color"
+		}
+	}
+	return ""
+}
+
+// solidImage 图片是否为单一颜色或全透明
+func solidImage(img image.Image, tolerance uint8) bool {
+	b := img.Bounds()
+	if b.Empty() {
+		return true
+	}
+	tol := uint32(tolerance) * 0x101
+	near := func(a, b uint32) bool {
+		if a > b {
+			return a-b <= tol
+		}
+		return b-a <= tol
+	}
+	r0, g0, b0, a0 := img.At(b.Min.X, b.Min.Y).RGBA()
+	transparent := true
+	solid := true
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			if a != 0 {
+				transparent = false
+			}
+			if solid && !(near(r, r0) && near(g, g0) && near(bl, b0) && near(a, a0)) {
+				solid = false
+			}
+			if !transparent && !solid {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// ContentError 响应内容与瓦片格式不符, 如以200返回的HTML错误页或JSON限流信息, 可重试
+type ContentError struct {
+	Format      string
+	ContentType string
+	Reason      string
+}
+
+func (e *ContentError) Error() string {
+	return fmt.Sprintf("invalid %s tile (content-type: %q): %s", e.Format, e.ContentType, e.Reason)
+}
+
+// tile magic numbers
+var (
+	pngMagic  = []byte("\x89PNG\r\n\x1a\n")
+	jpegMagic = []byte{0xff, 0xd8, 0xff}
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// checkContent 按瓦片格式校验Content-Type及文件头, 空内容交由调用方处理
+func checkContent(format, contentType string, body []byte) error {
+	if len(body) == 0 {
+		return nil
+	}
+	//文本类响应必然不是瓦片
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		if strings.HasPrefix(mt, "text/") || strings.HasSuffix(mt, "json") || strings.HasSuffix(mt, "xml") || strings.HasSuffix(mt, "html") {
+			return &ContentError{Format: format, ContentType: contentType, Reason: "unexpected content type " + mt}
+		}
+	}
+	if !matchMagic(format, body) {
+		n := len(body)
+		if n > 16 {
+			n = 16
+		}
+		return &ContentError{Format: format, ContentType: contentType, Reason: fmt.Sprintf("unexpected leading bytes %q", body[:n])}
+	}
+	return nil
+}
+
+// matchMagic 文件头是否符合瓦片格式, 未知格式不校验
+func matchMagic(format string, body []byte) bool {
+	switch format {
+	case PNG:
+		return bytes.HasPrefix(body, pngMagic)
+	case JPG, "jpeg":
+		return bytes.HasPrefix(body, jpegMagic)
+	case WEBP:
+		return len(body) >= 12 && string(body[0:4]) == "RIFF" && string(body[8:12]) == "WEBP"
+	case PBF:
+		//gzip压缩, 或原始protobuf以layers字段(3, length-delimited)开头
+		return bytes.HasPrefix(body, gzipMagic) || body[0] == 0x1a
+	}
+	return true
+}
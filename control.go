@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// watchSignals 监听系统信号控制任务, 中断信号取消任务, 再次中断强制退出
+func watchSignals(task *Task) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, controlSignals...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				switch signalAction(sig) {
+				case "pause":
+					task.pauseFun()
+				case "play":
+					task.playFun()
+				default:
+					if task.Aborted() {
+						log.Warnf("got %s again, force quit ~", sig)
+						os.Exit(1)
+					}
+					log.Warnf("got %s, aborting task %s, saving fetched tiles ~", sig, task.ID)
+					task.abortFun()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	watchKeys(task, done)
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
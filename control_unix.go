@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// controlSignals 任务控制信号, SIGUSR1暂停, SIGUSR2继续
+var controlSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2}
+
+func signalAction(sig os.Signal) string {
+	switch sig {
+	case syscall.SIGUSR1:
+		return "pause"
+	case syscall.SIGUSR2:
+		return "play"
+	}
+	return "abort"
+}
+
+// watchKeys 类unix系统使用信号暂停继续
+func watchKeys(task *Task, done <-chan struct{}) {}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// controlSignals 任务控制信号, windows无SIGUSR信号, 使用按键暂停继续
+var controlSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+func signalAction(sig os.Signal) string {
+	return "abort"
+}
+
+// watchKeys 读取控制台输入, p回车暂停, r回车继续
+func watchKeys(task *Task, done <-chan struct{}) {
+	log.Infof("press p<Enter> to pause, r<Enter> to resume ~")
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			switch strings.TrimSpace(scanner.Text()) {
+			case "p":
+				task.pauseFun()
+			case "r":
+				task.playFun()
+			}
+		}
+	}()
+}
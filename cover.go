@@ -0,0 +1,465 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/simplify"
+)
+
+// earthCircumference 赤道周长, 单位米
+const earthCircumference = 40075016.686
+
+// Distance 距离, 单位为米或瓦片边长
+type Distance struct {
+	Value float64
+	Tiles bool //为true时Value为瓦片边长的倍数
+}
+
+// parseDistance 解析距离, 支持500、500m、2km、1tile、0.5t、8px(按256像素瓦片), 不带单位时为米
+func parseDistance(s string) (Distance, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return Distance{}, nil
+	}
+	units := []struct {
+		suffix string
+		scale  float64
+		tiles  bool
+	}{
+		{"tiles", 1, true},
+		{"tile", 1, true},
+		{"px", 1.0 / 256, true},
+		{"km", 1000, false},
+		{"m", 1, false},
+		{"t", 1, true},
+	}
+	num, scale, tiles := s, 1.0, false
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			num, scale, tiles = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.scale, u.tiles
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) {
+		return Distance{}, fmt.Errorf("invalid distance %q", s)
+	}
+	return Distance{Value: v * scale, Tiles: tiles}, nil
+}
+
+// IsZero 距离是否为0
+func (d Distance) IsZero() bool {
+	return d.Value == 0
+}
+
+// tiles 纬度lat处的距离换算为z级瓦片边长的倍数
+func (d Distance) tiles(lat float64, z maptile.Zoom) float64 {
+	if d.Tiles {
+		return d.Value
+	}
+	cos := math.Max(math.Cos(lat*math.Pi/180), 1e-6)
+	return d.Value * float64(uint64(1)<<z) / (earthCircumference * cos)
+}
+
+// String 距离的文字表示
+func (d Distance) String() string {
+	if d.Tiles {
+		return strconv.FormatFloat(d.Value, 'f', -1, 64) + "tile"
+	}
+	return strconv.FormatFloat(d.Value, 'f', -1, 64) + "m"
+}
+
+// Coverage 按buffer外扩、simplify简化后的层级覆盖范围
+// 几何先在该级别瓦片坐标下简化, 再取距简化后边界buffer+简化容差以内的瓦片作为边缘瓦片,
+// 简化后的轮廓与原轮廓相差不超过容差, 原轮廓覆盖的瓦片均在其中
+type Coverage struct {
+	Shape  orb.Collection //简化后的面, 用于计算内部瓦片
+	Margin maptile.Set    //边缘瓦片, 覆盖计算时内部瓦片跳过这些瓦片
+	Count  int64
+}
+
+// NewCoverage 计算z级的覆盖范围
+func NewCoverage(c orb.Collection, z maptile.Zoom, buffer, tolerance Distance) *Coverage {
+	cv := &Coverage{Margin: make(maptile.Set)}
+	var polygons []orb.Polygon
+	for _, g := range c {
+		tol := 0.0
+		if !tolerance.IsZero() {
+			b := g.Bound()
+			tol = tolerance.tiles(b.Center()[1], z)
+		}
+		g = simplifyGeometry(g, z, tol)
+		//线和点覆盖的瓦片均在边缘瓦片中, 只有面需要计算内部瓦片
+		for _, ls := range coverLines(g) {
+			cv.addMargin(ls, z, buffer, tol)
+		}
+		switch g := g.(type) {
+		case orb.Polygon:
+			polygons = append(polygons, g)
+		case orb.MultiPolygon:
+			polygons = append(polygons, g...)
+		}
+	}
+	cv.Count = int64(len(cv.Margin))
+	for _, p := range polygons {
+		cv.Shape = append(cv.Shape, p)
+		cv.Count += cv.interior(p, z)
+	}
+	return cv
+}
+
+// simplifyGeometry 在z级瓦片坐标下按容差简化线和面
+func simplifyGeometry(g orb.Geometry, z maptile.Zoom, tol float64) orb.Geometry {
+	if tol <= 0 {
+		return g
+	}
+	switch g := g.(type) {
+	case orb.LineString:
+		return simplifyLine(g, z, tol, 2)
+	case orb.MultiLineString:
+		out := make(orb.MultiLineString, len(g))
+		for i, ls := range g {
+			out[i] = simplifyLine(ls, z, tol, 2)
+		}
+		return out
+	case orb.Polygon:
+		return simplifyPolygon(g, z, tol)
+	case orb.MultiPolygon:
+		out := make(orb.MultiPolygon, len(g))
+		for i, p := range g {
+			out[i] = simplifyPolygon(p, z, tol)
+		}
+		return out
+	}
+	return g
+}
+
+// coverLines 几何的边界线, 点视为零长度的线
+func coverLines(g orb.Geometry) []orb.LineString {
+	var lines []orb.LineString
+	switch g := g.(type) {
+	case orb.Point:
+		lines = append(lines, orb.LineString{g, g})
+	case orb.MultiPoint:
+		for _, p := range g {
+			lines = append(lines, orb.LineString{p, p})
+		}
+	case orb.LineString:
+		lines = append(lines, g)
+	case orb.MultiLineString:
+		lines = append(lines, g...)
+	case orb.Polygon:
+		for _, r := range g {
+			lines = append(lines, orb.LineString(r))
+		}
+	case orb.MultiPolygon:
+		for _, p := range g {
+			lines = append(lines, coverLines(p)...)
+		}
+	case orb.Collection:
+		for _, c := range g {
+			lines = append(lines, coverLines(c)...)
+		}
+	}
+	return lines
+}
+
+// simplifyPolygon 面的各环按容差简化, 简化后退化的环保持原样
+func simplifyPolygon(p orb.Polygon, z maptile.Zoom, tol float64) orb.Polygon {
+	out := make(orb.Polygon, len(p))
+	for i, r := range p {
+		out[i] = orb.Ring(simplifyLine(orb.LineString(r), z, tol, 4))
+	}
+	return out
+}
+
+// simplifyLine 在z级瓦片坐标下按容差简化线, 点数少于min时保持原样
+func simplifyLine(ls orb.LineString, z maptile.Zoom, tol float64, min int) orb.LineString {
+	if len(ls) <= min {
+		return ls
+	}
+	projected := make(orb.LineString, len(ls))
+	for i, p := range ls {
+		projected[i] = maptile.Fraction(p, z)
+	}
+	projected = simplify.DouglasPeucker(tol).LineString(projected)
+	if len(projected) < min {
+		return ls
+	}
+	out := make(orb.LineString, len(projected))
+	for i, p := range projected {
+		out[i] = fractionLonLat(p, z)
+	}
+	return out
+}
+
+// fractionLonLat z级瓦片坐标转为经纬度, 与maptile.Fraction互逆
+func fractionLonLat(p orb.Point, z maptile.Zoom) orb.Point {
+	n := float64(uint64(1) << z)
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*p[1]/n))) * 180 / math.Pi
+	return orb.Point{p[0]/n*360 - 180, lat}
+}
+
+// addMargin 将距线ls各段buffer+tol以内的瓦片加入边缘瓦片
+// 逐行取线段落在该行上下扩展距离后的横向范围, 再左右扩展距离, 拐角处略大于实际缓冲区
+func (cv *Coverage) addMargin(ls orb.LineString, z maptile.Zoom, buffer Distance, tol float64) {
+	n := float64(uint64(1) << z)
+	clamp := func(v float64) float64 {
+		return math.Max(0, math.Min(n-1, v))
+	}
+	for i := 0; i+1 < len(ls); i++ {
+		a, b := maptile.Fraction(ls[i], z), maptile.Fraction(ls[i+1], z)
+		lat := math.Max(math.Abs(ls[i][1]), math.Abs(ls[i+1][1]))
+		d := buffer.tiles(lat, z) + tol
+		y0 := clamp(math.Floor(math.Min(a[1], b[1]) - d))
+		y1 := clamp(math.Floor(math.Max(a[1], b[1]) + d))
+		for y := y0; y <= y1; y++ {
+			lo, hi := y-d, y+1+d
+			t0, t1 := 0.0, 1.0
+			if a[1] == b[1] {
+				if a[1] < lo || a[1] > hi {
+					continue
+				}
+			} else {
+				t0, t1 = (lo-a[1])/(b[1]-a[1]), (hi-a[1])/(b[1]-a[1])
+				if t0 > t1 {
+					t0, t1 = t1, t0
+				}
+				t0, t1 = math.Max(t0, 0), math.Min(t1, 1)
+				if t0 > t1 {
+					continue
+				}
+			}
+			xa, xb := a[0]+t0*(b[0]-a[0]), a[0]+t1*(b[0]-a[0])
+			if xa > xb {
+				xa, xb = xb, xa
+			}
+			for x := clamp(math.Floor(xa - d)); x <= clamp(math.Floor(xb+d)); x++ {
+				cv.Margin[maptile.New(uint32(x), uint32(y), z)] = true
+			}
+		}
+	}
+}
+
+// interior 面内部不属于边缘瓦片的瓦片数, 按瓦片中心是否在面内判断, 边界经过的瓦片均为边缘瓦片
+func (cv *Coverage) interior(p orb.Polygon, z maptile.Zoom) int64 {
+	rows := make(map[float64][]float64)
+	for _, r := range p {
+		ring := make(orb.Ring, len(r))
+		for j, pt := range r {
+			ring[j] = maptile.Fraction(pt, z)
+		}
+		//各边与经过的瓦片行中线的交点
+		for j := 0; j+1 < len(ring); j++ {
+			a, b := ring[j], ring[j+1]
+			if a[1] == b[1] {
+				continue
+			}
+			if a[1] > b[1] {
+				a, b = b, a
+			}
+			for y := math.Ceil(a[1] - 0.5); y+0.5 < b[1]; y++ {
+				x := a[0] + (y+0.5-a[1])/(b[1]-a[1])*(b[0]-a[0])
+				rows[y] = append(rows[y], x)
+			}
+		}
+	}
+	var n int64
+	for _, xs := range rows {
+		sort.Float64s(xs)
+		for i := 0; i+1 < len(xs); i += 2 {
+			n += int64(math.Max(0, math.Ceil(xs[i+1]-0.5)-math.Ceil(xs[i]-0.5)))
+		}
+	}
+	//行中线上位于瓦片中心左侧的交点数为奇数时, 瓦片在面内
+	for t := range cv.Margin {
+		xs := rows[float64(t.Y)]
+		c := float64(t.X) + 0.5
+		if sort.Search(len(xs), func(i int) bool { return xs[i] > c })%2 == 1 {
+			n--
+		}
+	}
+	return n
+}
+
+// coverTiles 逐个生成几何覆盖的瓦片, 结果与tilecover一致, emit返回false时立即停止并返回false
+// 面按行扫描填充, 每个瓦片都检查emit, 任务取消后不再继续计算
+func coverTiles(g orb.Geometry, z maptile.Zoom, emit func(maptile.Tile) bool) bool {
+	switch g := g.(type) {
+	case orb.Point:
+		return emit(maptile.At(g, z))
+	case orb.MultiPoint:
+		//与tilecover一致, 同一瓦片中的点只发送一次
+		set := make(maptile.Set)
+		for _, p := range g {
+			set[maptile.At(p, z)] = true
+		}
+		return emitSet(set, emit)
+	case orb.LineString:
+		//与tilecover一致, 单条线边走边发送, 不去重
+		_, ok := coverLine(g, z, nil, emit)
+		return ok
+	case orb.MultiLineString:
+		set := make(maptile.Set)
+		for _, ls := range g {
+			coverLine(ls, z, nil, setAdder(set))
+		}
+		return emitSet(set, emit)
+	case orb.Ring:
+		if len(g) > 0 {
+			return coverPolygon(orb.Polygon{g}, z, emit)
+		}
+	case orb.Polygon:
+		return coverPolygon(g, z, emit)
+	case orb.MultiPolygon:
+		for _, p := range g {
+			if !coverPolygon(p, z, emit) {
+				return false
+			}
+		}
+	case orb.Collection:
+		for _, sub := range g {
+			if !coverTiles(sub, z, emit) {
+				return false
+			}
+		}
+	case orb.Bound:
+		lo, hi := maptile.At(g.Min, z), maptile.At(g.Max, z)
+		for x := lo.X; x <= hi.X; x++ {
+			for y := hi.Y; y <= lo.Y; y++ {
+				if !emit(maptile.New(x, y, z)) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// emitSet 逐个发送瓦片集
+func emitSet(set maptile.Set, emit func(maptile.Tile) bool) bool {
+	for t := range set {
+		if !emit(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// coverPolygon 面覆盖的瓦片, 先发送边界瓦片, 再逐行填充边界之间的瓦片
+func coverPolygon(p orb.Polygon, z maptile.Zoom, emit func(maptile.Tile) bool) bool {
+	set := make(maptile.Set)
+	add := setAdder(set)
+	var intersections [][2]uint32
+	for _, r := range p {
+		ring, _ := coverLine(orb.LineString(r), z, make([][2]uint32, 0), add)
+		pi := len(ring) - 2
+		for i := range ring {
+			pi = (pi + 1) % len(ring)
+			ni := (i + 1) % len(ring)
+			y := ring[i][1]
+			//不是局部极值且不与下一点同行时为交点
+			if (y > ring[pi][1] || y > ring[ni][1]) &&
+				(y < ring[pi][1] || y < ring[ni][1]) &&
+				y != ring[ni][1] {
+				intersections = append(intersections, ring[i])
+			}
+		}
+	}
+	sort.Slice(intersections, func(i, j int) bool {
+		if intersections[i][1] != intersections[j][1] {
+			return intersections[i][1] < intersections[j][1]
+		}
+		return intersections[i][0] < intersections[j][0]
+	})
+	if !emitSet(set, emit) {
+		return false
+	}
+	for i := 0; i+1 < len(intersections); i += 2 {
+		y := intersections[i][1]
+		for x := intersections[i][0] + 1; x < intersections[i+1][0]; x++ {
+			if !emit(maptile.New(x, y, z)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// coverLine 线经过的瓦片逐个交给visit, visit返回false时停止; ring不为nil时记录换行处的瓦片, 用于面的扫描填充
+func coverLine(ls orb.LineString, z maptile.Zoom, ring [][2]uint32, visit func(maptile.Tile) bool) ([][2]uint32, bool) {
+	inf := math.Inf(1)
+	prevX, prevY := -1.0, -1.0
+	var x, y float64
+	add := func() bool {
+		if ring != nil && y != prevY {
+			ring = append(ring, [2]uint32{uint32(x), uint32(y)})
+		}
+		prevX, prevY = x, y
+		return visit(maptile.New(uint32(x), uint32(y), z))
+	}
+	for i := 0; i < len(ls)-1; i++ {
+		start, stop := maptile.Fraction(ls[i], z), maptile.Fraction(ls[i+1], z)
+		dx, dy := stop[0]-start[0], stop[1]-start[1]
+		if dx == 0 && dy == 0 {
+			continue
+		}
+		sx, sy := -1.0, -1.0
+		if dx > 0 {
+			sx = 1
+		}
+		if dy > 0 {
+			sy = 1
+		}
+		x, y = math.Floor(start[0]), math.Floor(start[1])
+		tMaxX, tMaxY := inf, inf
+		if dx != 0 {
+			d := 0.0
+			if dx > 0 {
+				d = 1
+			}
+			tMaxX = math.Abs((d + x - start[0]) / dx)
+		}
+		if dy != 0 {
+			d := 0.0
+			if dy > 0 {
+				d = 1
+			}
+			tMaxY = math.Abs((d + y - start[1]) / dy)
+		}
+		tdx, tdy := math.Abs(sx/dx), math.Abs(sy/dy)
+		if (x != prevX || y != prevY) && !add() {
+			return ring, false
+		}
+		for tMaxX < 1 || tMaxY < 1 {
+			if tMaxX < tMaxY {
+				tMaxX += tdx
+				x += sx
+			} else {
+				tMaxY += tdy
+				y += sy
+			}
+			if !add() {
+				return ring, false
+			}
+		}
+	}
+	if len(ring) > 0 && uint32(y) == ring[0][1] {
+		ring = ring[:len(ring)-1]
+	}
+	return ring, true
+}
+
+// setAdder 将瓦片加入set的visit函数
+func setAdder(set maptile.Set) func(maptile.Tile) bool {
+	return func(t maptile.Tile) bool {
+		set[t] = true
+		return true
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/maptile/tilecover"
+)
+
+func TestCoverTilesMatchesTilecover(t *testing.T) {
+	nanjing, err := loadRegion("geojson/nanjing.geojson", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	holed := orb.Polygon{
+		{{118.2, 31.2}, {119.3, 31.2}, {119.3, 32.6}, {118.2, 32.6}, {118.2, 31.2}},
+		{{118.6, 31.6}, {118.6, 32.2}, {118.9, 32.2}, {118.9, 31.6}, {118.6, 31.6}},
+	}
+	geoms := []struct {
+		name string
+		g    orb.Geometry
+	}{
+		{"point", orb.Point{118.78, 32.04}},
+		{"multipoint", orb.MultiPoint{{118.78, 32.04}, {118.79, 32.05}, {-70.1, -33.4}}},
+		{"line", orb.LineString{{118.2, 31.2}, {118.9, 31.9}, {119.3, 31.3}, {118.5, 32.6}}},
+		{"multiline", orb.MultiLineString{{{118.2, 31.2}, {119.3, 32.6}}, {{118.2, 32.6}, {119.3, 31.2}}}},
+		{"polygon with hole", holed},
+		{"multipolygon", orb.MultiPolygon{holed, {{{-10, -10}, {-9.5, -10}, {-9.7, -9.2}, {-10, -10}}}}},
+		{"boundary", nanjing[0]},
+	}
+	for _, c := range geoms {
+		for z := maptile.Zoom(0); z <= 14; z++ {
+			got := make(maptile.Set)
+			var emitted int64
+			coverTiles(c.g, z, func(t maptile.Tile) bool {
+				got[t] = true
+				emitted++
+				return true
+			})
+			want := tilecover.Geometry(c.g, z)
+			if len(got) != len(want) {
+				t.Errorf("%s z%d: %d tiles, want %d", c.name, z, len(got), len(want))
+				continue
+			}
+			for tile := range want {
+				if !got[tile] {
+					t.Errorf("%s z%d: missing %v", c.name, z, tile)
+					break
+				}
+			}
+			//进度总数按tilecover计算, 派发数需一致
+			if n := tilecover.GeometryCount(c.g, z); emitted != n {
+				t.Errorf("%s z%d: emitted %d tiles, count %d", c.name, z, emitted, n)
+			}
+		}
+	}
+}
+
+func TestCoverTilesStop(t *testing.T) {
+	p := orb.Polygon{{{118.2, 31.2}, {119.3, 31.2}, {119.3, 32.6}, {118.2, 32.6}, {118.2, 31.2}}}
+	n := 0
+	ok := coverTiles(p, 14, func(maptile.Tile) bool {
+		n++
+		return n < 10
+	})
+	if ok || n != 10 {
+		t.Errorf("cover after stop: ok = %v, emitted %d, want false after 10", ok, n)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/chai2010/webp"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// RasterEncoder 栅格瓦片重新编码, 在下载与保存之间转换格式及压缩质量
+type RasterEncoder struct {
+	Format   string //输出格式png/jpg/webp
+	Quality  int    //jpg/webp压缩质量1-100
+	Lossless bool   //webp无损压缩
+}
+
+// NewRasterEncoder 从配置创建编码器, 未配置输出格式或源为矢量瓦片时返回nil
+func NewRasterEncoder(src string) *RasterEncoder {
+	format := viper.GetString("output.encode.format")
+	if format == "" {
+		return nil
+	}
+	if format == "jpeg" {
+		format = JPG
+	}
+	switch format {
+	case PNG, JPG, WEBP:
+	default:
+		log.Warnf("unsupported encode format %q, keep %s ~", format, src)
+		return nil
+	}
+	if src == PBF {
+		log.Warnf("can not encode %s tiles to %s, keep %s ~", src, format, src)
+		return nil
+	}
+	return rasterEncoder(format)
+}
+
+// rasterEncoder 按配置的压缩质量创建指定格式的编码器
+func rasterEncoder(format string) *RasterEncoder {
+	e := &RasterEncoder{
+		Format:   format,
+		Quality:  viper.GetInt("output.encode.quality"),
+		Lossless: viper.GetBool("output.encode.lossless"),
+	}
+	if e.Format == "jpeg" {
+		e.Format = JPG
+	}
+	if e.Quality < 1 || e.Quality > 100 {
+		e.Quality = jpeg.DefaultQuality
+	}
+	return e
+}
+
+// Encode 解码瓦片并按输出格式重新编码
+func (e *RasterEncoder) Encode(body []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("decode tile error: %s", err)
+	}
+	return e.EncodeImage(img)
+}
+
+// EncodeImage 按输出格式编码图片, jpg不支持透明, 透明部分填充白色
+func (e *RasterEncoder) EncodeImage(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch e.Format {
+	case PNG:
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		err = enc.Encode(&buf, img)
+	case JPG:
+		b := img.Bounds()
+		flat := image.NewRGBA(b)
+		draw.Draw(flat, b, image.White, image.Point{}, draw.Src)
+		draw.Draw(flat, b, img, b.Min, draw.Over)
+		err = jpeg.Encode(&buf, flat, &jpeg.Options{Quality: e.Quality})
+	case WEBP:
+		err = webp.Encode(&buf, img, &webp.Options{Lossless: e.Lossless, Quality: float32(e.Quality)})
+	default:
+		err = fmt.Errorf("unsupported format %s", e.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/project"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadRegion 读取范围文件并按where筛选要素, 支持GeoJSON、Shapefile、KML/KMZ及GeoPackage矢量图层
+// table为GeoPackage的要素表名, 文件中只有一个要素表时可为空
+func loadRegion(path, table, where string) (orb.Collection, error) {
+	features, err := loadFeatures(path, table)
+	if err != nil {
+		return nil, err
+	}
+	return filterFeatures(path, features, where)
+}
+
+// loadFeatures 按扩展名读取要素
+func loadFeatures(path, table string) ([]*geojson.Feature, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".shp":
+		return loadShapefile(path)
+	case ".kml", ".kmz":
+		return loadKML(path)
+	case ".gpkg":
+		return loadGpkgFeatures(path, table)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseFeatures(data)
+}
+
+// parseFeatures 解析GeoJSON要素, 支持FeatureCollection、Feature和Geometry
+func parseFeatures(data []byte) ([]*geojson.Feature, error) {
+	fc, err := geojson.UnmarshalFeatureCollection(data)
+	if err == nil && len(fc.Features) > 0 {
+		return fc.Features, nil
+	}
+
+	f, err := geojson.UnmarshalFeature(data)
+	if err == nil && f.Geometry != nil {
+		return []*geojson.Feature{f}, nil
+	}
+
+	g, err := geojson.UnmarshalGeometry(data)
+	if err != nil {
+		return nil, err
+	}
+	return []*geojson.Feature{geojson.NewFeature(g.Geometry())}, nil
+}
+
+// filterFeatures 按where筛选要素并返回几何, 没有要素或坐标超出经纬度范围时返回错误
+func filterFeatures(name string, features []*geojson.Feature, where string) (orb.Collection, error) {
+	match := func(geojson.Properties) bool { return true }
+	if strings.TrimSpace(where) != "" {
+		f, err := parseWhere(where)
+		if err != nil {
+			return nil, err
+		}
+		match = f
+	}
+	var c orb.Collection
+	for _, f := range features {
+		if f.Geometry != nil && match(f.Properties) {
+			c = appendGeometry(c, f.Geometry)
+		}
+	}
+	if len(c) == 0 {
+		if where != "" {
+			return nil, fmt.Errorf("no feature of %s matches %q", name, where)
+		}
+		return nil, fmt.Errorf("no feature in %s", name)
+	}
+	if where != "" {
+		log.Infof("%d of %d features in %s match %q ~", len(c), len(features), name, where)
+	}
+	b := c.Bound()
+	if b.Min[0] < -180 || b.Max[0] > 180 || b.Min[1] < -90 || b.Max[1] > 90 {
+		return nil, fmt.Errorf("coordinates of %s are not longitude/latitude, bound %v", name, b)
+	}
+	return c, nil
+}
+
+// appendGeometry 几何加入集合, 嵌套的集合展开
+func appendGeometry(c orb.Collection, g orb.Geometry) orb.Collection {
+	if gc, ok := g.(orb.Collection); ok {
+		for _, sub := range gc {
+			c = appendGeometry(c, sub)
+		}
+		return c
+	}
+	return append(c, g)
+}
+
+// prjProjection 坐标系定义对应的转换, 地理坐标系(WGS84、CGCS2000等)不转换, 投影坐标系只支持web墨卡托
+func prjProjection(wkt string) (orb.Projection, error) {
+	w := strings.ToUpper(strings.TrimSpace(wkt))
+	switch {
+	case w == "", strings.HasPrefix(w, "GEOGCS"), strings.HasPrefix(w, "GEOGCRS"), strings.HasPrefix(w, "GEODCRS"):
+		return nil, nil
+	case strings.Contains(w, "MERCATOR_AUXILIARY_SPHERE"), strings.Contains(w, "PSEUDO-MERCATOR"),
+		strings.Contains(w, "PSEUDO_MERCATOR"), strings.Contains(w, "WEB_MERCATOR"), strings.Contains(w, "900913"):
+		return project.Mercator.ToWGS84, nil
+	}
+	return nil, fmt.Errorf("unsupported coordinate system, reproject it to WGS84 (EPSG:4326) or web mercator (EPSG:3857)")
+}
+
+// projectFeatures 要素坐标转为经纬度, proj为空时不转换
+func projectFeatures(features []*geojson.Feature, proj orb.Projection) []*geojson.Feature {
+	if proj == nil {
+		return features
+	}
+	for _, f := range features {
+		f.Geometry = project.Geometry(f.Geometry, proj)
+	}
+	return features
+}
@@ -4,6 +4,7 @@ go 1.15
 
 require (
 	github.com/antonfisher/nested-logrus-formatter v1.3.0
+	github.com/chai2010/webp v1.4.0
 	github.com/mattn/go-runewidth v0.0.9 // indirect
 	github.com/mattn/go-sqlite3 v1.14.19
 	github.com/paulmach/orb v0.1.6
@@ -11,7 +12,8 @@ require (
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/viper v1.7.1
 	github.com/teris-io/shortid v0.0.0-20220617161101-71ec9f2aa569
-	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd // indirect
+	golang.org/x/image v0.18.0
+	golang.org/x/text v0.16.0
 	gopkg.in/cheggaaa/pb.v1 v1.0.28
 )
 
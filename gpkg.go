@@ -0,0 +1,546 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/project"
+)
+
+// GeoPackage 1.2 文件标识
+const (
+	GPKGApplicationID = 0x47504B47 //"GPKG"
+	GPKGUserVersion   = 10200
+)
+
+// gpkgSRS 必需的坐标系及web墨卡托
+var gpkgSRS = []struct {
+	Name       string
+	ID         int
+	Org        string
+	OrgID      int
+	Definition string
+}{
+	{"Undefined cartesian SRS", -1, "NONE", -1, "undefined"},
+	{"Undefined geographic SRS", 0, "NONE", 0, "undefined"},
+	{"WGS 84 geodetic", 4326, "EPSG", 4326, `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]`},
+	{"WGS 84 / Pseudo-Mercator", 3857, "EPSG", 3857, `PROJCS["WGS 84 / Pseudo-Mercator",GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]],PROJECTION["Mercator_1SP"],PARAMETER["central_meridian",0],PARAMETER["scale_factor",1],PARAMETER["false_easting",0],PARAMETER["false_northing",0],UNIT["metre",1,AUTHORITY["EPSG","9001"]],AXIS["X",EAST],AXIS["Y",NORTH],EXTENSION["PROJ4","+proj=merc +a=6378137 +b=6378137 +lat_ts=0.0 +lon_0=0.0 +x_0=0.0 +y_0=0 +k=1.0 +units=m +nadgrids=@null +wktext +no_defs"],AUTHORITY["EPSG","3857"]]`},
+}
+
+var gpkgTableRe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// gpkgTable 瓦片表名, 取地图名称中的合法字符
+func gpkgTable(name string) string {
+	table := gpkgTableRe.ReplaceAllString(name, "_")
+	if table == "" {
+		return "tiles"
+	}
+	if table[0] >= '0' && table[0] <= '9' {
+		table = "t_" + table
+	}
+	return table
+}
+
+// GPKGStore GeoPackage瓦片金字塔存储, 与MBTiles共用sqlite驱动及批量写入
+type GPKGStore struct {
+	File       string
+	Table      string //瓦片表名
+	Keep       bool   //保留已有文件
+	Update     bool   //update模式, 替换已存在的瓦片并保存校验信息
+	db         *sql.DB
+	insertStmt *sql.Stmt
+	validStmt  *sql.Stmt
+}
+
+// Open 创建GeoPackage必需的表及瓦片表
+func (s *GPKGStore) Open() error {
+	if !s.Keep {
+		os.Remove(s.File)
+	}
+	db, err := sql.Open("sqlite3", s.File)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1)
+
+	err = optimizeConnection(db)
+	if err != nil {
+		return err
+	}
+
+	stmts := []string{
+		fmt.Sprintf("PRAGMA application_id = %d;", GPKGApplicationID),
+		fmt.Sprintf("PRAGMA user_version = %d;", GPKGUserVersion),
+		`create table if not exists gpkg_spatial_ref_sys (
+			srs_name text not null,
+			srs_id integer primary key,
+			organization text not null,
+			organization_coordsys_id integer not null,
+			definition text not null,
+			description text);`,
+		`create table if not exists gpkg_contents (
+			table_name text not null primary key,
+			data_type text not null,
+			identifier text unique,
+			description text default '',
+			last_change datetime not null default (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+			min_x double, min_y double, max_x double, max_y double,
+			srs_id integer,
+			constraint fk_gc_r_srs_id foreign key (srs_id) references gpkg_spatial_ref_sys(srs_id));`,
+		`create table if not exists gpkg_tile_matrix_set (
+			table_name text not null primary key,
+			srs_id integer not null,
+			min_x double not null, min_y double not null, max_x double not null, max_y double not null,
+			constraint fk_gtms_table_name foreign key (table_name) references gpkg_contents(table_name),
+			constraint fk_gtms_srs foreign key (srs_id) references gpkg_spatial_ref_sys (srs_id));`,
+		`create table if not exists gpkg_tile_matrix (
+			table_name text not null,
+			zoom_level integer not null,
+			matrix_width integer not null,
+			matrix_height integer not null,
+			tile_width integer not null,
+			tile_height integer not null,
+			pixel_x_size double not null,
+			pixel_y_size double not null,
+			constraint pk_ttm primary key (table_name, zoom_level),
+			constraint fk_tmm_table_name foreign key (table_name) references gpkg_contents(table_name));`,
+		fmt.Sprintf(`create table if not exists "%s" (
+			id integer primary key autoincrement,
+			zoom_level integer not null,
+			tile_column integer not null,
+			tile_row integer not null,
+			tile_data blob not null,
+			unique (zoom_level, tile_column, tile_row));`, s.Table),
+	}
+	for _, stmt := range stmts {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, srs := range gpkgSRS {
+		_, err = db.Exec("insert or ignore into gpkg_spatial_ref_sys (srs_name, srs_id, organization, organization_coordsys_id, definition) values (?, ?, ?, ?, ?)",
+			srs.Name, srs.ID, srs.Org, srs.OrgID, srs.Definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	//仅update模式保存校验信息, 其他模式不在发布的文件中添加tile_validators表
+	if s.Update {
+		err = setupValidatorTable(db)
+		if err != nil {
+			return err
+		}
+		s.validStmt, err = prepareValidator(db)
+		if err != nil {
+			return err
+		}
+	}
+
+	insert := "insert"
+	if s.Update {
+		insert = "insert or replace"
+	}
+	s.insertStmt, err = db.Prepare(fmt.Sprintf(`%s into "%s" (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?);`, insert, s.Table))
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+// Put 写入瓦片
+func (s *GPKGStore) Put(tile Tile) error {
+	return s.PutBatch([]Tile{tile})[tile.T]
+}
+
+// PutBatch 事务批量写入瓦片
+func (s *GPKGStore) PutBatch(tiles []Tile) map[maptile.Tile]error {
+	return putSQLiteBatch(s.db, tiles, func(tx *sql.Tx) func(Tile) error {
+		stmt := tx.Stmt(s.insertStmt)
+		var validStmt *sql.Stmt
+		if s.validStmt != nil {
+			validStmt = tx.Stmt(s.validStmt)
+		}
+		return func(tile Tile) error {
+			err := saveToGPKG(tile, stmt)
+			if err != nil {
+				return err
+			}
+			if validStmt == nil {
+				return nil
+			}
+			return saveValidator(validStmt, tile.T.Z, tile.T.X, tile.T.Y, tile.V)
+		}
+	})
+}
+
+// Has 瓦片是否已存在
+func (s *GPKGStore) Has(t maptile.Tile) (bool, error) {
+	var n int
+	err := s.db.QueryRow(fmt.Sprintf(`select count(*) from "%s" where zoom_level = ? and tile_column = ? and tile_row = ?;`, s.Table), t.Z, t.X, t.Y).Scan(&n)
+	return n > 0, err
+}
+
+// Get 读取瓦片
+func (s *GPKGStore) Get(t maptile.Tile) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(fmt.Sprintf(`select tile_data from "%s" where zoom_level = ? and tile_column = ? and tile_row = ?;`, s.Table), t.Z, t.X, t.Y).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrTileNotFound
+	}
+	return data, err
+}
+
+// Validator 读取瓦片校验信息, 非update模式时返回空
+func (s *GPKGStore) Validator(t maptile.Tile) (Validator, error) {
+	if s.validStmt == nil {
+		return Validator{}, nil
+	}
+	return queryValidator(s.db, t.Z, t.X, t.Y)
+}
+
+// WriteMetadata 写入gpkg_contents及金字塔各级矩阵, 数据范围取自bounds项, 保留已有文件时与原范围合并
+func (s *GPKGStore) WriteMetadata(meta map[string]string) error {
+	b := mercatorBound(metaBound(meta))
+	if s.Keep {
+		var old orb.Bound
+		err := s.db.QueryRow("select min_x, min_y, max_x, max_y from gpkg_contents where table_name = ?;", s.Table).Scan(&old.Min[0], &old.Min[1], &old.Max[0], &old.Max[1])
+		if err == nil {
+			b = b.Union(old)
+		}
+	}
+	_, err := s.db.Exec("insert or replace into gpkg_contents (table_name, data_type, identifier, description, min_x, min_y, max_x, max_y, srs_id) values (?, 'tiles', ?, ?, ?, ?, ?, ?, 3857)",
+		s.Table, meta["name"], meta["description"], b.Left(), b.Bottom(), b.Right(), b.Top())
+	if err != nil {
+		return err
+	}
+	//金字塔范围为整个web墨卡托平面
+	_, err = s.db.Exec("insert or replace into gpkg_tile_matrix_set (table_name, srs_id, min_x, min_y, max_x, max_y) values (?, 3857, ?, ?, ?, ?)",
+		s.Table, -mercatorOrigin, -mercatorOrigin, mercatorOrigin, mercatorOrigin)
+	if err != nil {
+		return err
+	}
+	min, max := metaZoom(meta)
+	for z := min; z <= max; z++ {
+		n := 1 << uint(z)
+		size := 2 * mercatorOrigin / float64(n*TileSize)
+		_, err = s.db.Exec("insert or replace into gpkg_tile_matrix (table_name, zoom_level, matrix_width, matrix_height, tile_width, tile_height, pixel_x_size, pixel_y_size) values (?, ?, ?, ?, ?, ?, ?, ?)",
+			s.Table, z, n, n, TileSize, TileSize, size, size)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 关闭预编译语句及数据库
+func (s *GPKGStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	s.insertStmt.Close()
+	if s.validStmt != nil {
+		s.validStmt.Close()
+	}
+	return s.db.Close()
+}
+
+// saveToGPKG GeoPackage瓦片行号自上而下, 与XYZ一致
+func saveToGPKG(tile Tile, stmt *sql.Stmt) error {
+	_, err := stmt.Exec(tile.T.Z, tile.T.X, tile.T.Y, tile.C)
+	return err
+}
+
+// mercatorBound 经纬度范围转为EPSG:3857, 纬度限制在web墨卡托范围内
+func mercatorBound(b orb.Bound) orb.Bound {
+	if b.IsEmpty() {
+		return orb.Bound{Min: orb.Point{-mercatorOrigin, -mercatorOrigin}, Max: orb.Point{mercatorOrigin, mercatorOrigin}}
+	}
+	const maxLat = 85.0511287798066
+	clamp := func(p orb.Point) orb.Point {
+		return orb.Point{p.X(), math.Max(-maxLat, math.Min(maxLat, p.Y()))}
+	}
+	return orb.Bound{
+		Min: project.WGS84.ToMercator(clamp(b.Min)),
+		Max: project.WGS84.ToMercator(clamp(b.Max)),
+	}
+}
+
+// loadGpkgFeatures 读取GeoPackage矢量图层, table为空时使用文件中唯一的要素表
+func loadGpkgFeatures(file, table string) ([]*geojson.Feature, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT c.table_name, g.column_name, g.srs_id FROM gpkg_contents c
+		JOIN gpkg_geometry_columns g ON c.table_name = g.table_name WHERE c.data_type = 'features'`)
+	if err != nil {
+		return nil, fmt.Errorf("read feature tables of %s error: %s", file, err)
+	}
+	type featureTable struct {
+		name   string
+		column string //几何字段
+		srs    int
+	}
+	var names []string
+	tables := make(map[string]featureTable)
+	for rows.Next() {
+		var t featureTable
+		if err := rows.Scan(&t.name, &t.column, &t.srs); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, t.name)
+		tables[strings.ToLower(t.name)] = t
+	}
+	rows.Close()
+	if table == "" {
+		if len(names) != 1 {
+			return nil, fmt.Errorf("%s has %d feature tables %v, set table to pick one", file, len(names), names)
+		}
+		table = names[0]
+	}
+	t, ok := tables[strings.ToLower(table)]
+	if !ok {
+		return nil, fmt.Errorf("feature table %q not found in %s, tables: %v", table, file, names)
+	}
+	table, column, srs := t.name, t.column, t.srs
+	proj, err := gpkgProjection(db, srs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	rows, err = db.Query(fmt.Sprintf(`SELECT * FROM "%s"`, strings.ReplaceAll(table, `"`, `""`)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var features []*geojson.Feature
+	values := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		var g orb.Geometry
+		props := make(geojson.Properties)
+		for i, col := range cols {
+			if strings.EqualFold(col, column) {
+				b, _ := values[i].([]byte)
+				if g, err = gpkgGeometry(b); err != nil {
+					return nil, fmt.Errorf("%s feature %d: %s", table, len(features)+1, err)
+				}
+				continue
+			}
+			switch v := values[i].(type) {
+			case nil:
+			case []byte:
+				props[col] = string(v)
+			default:
+				props[col] = v
+			}
+		}
+		if g == nil {
+			continue
+		}
+		f := geojson.NewFeature(g)
+		f.Properties = props
+		features = append(features, f)
+	}
+	return projectFeatures(features, proj), rows.Err()
+}
+
+// gpkgProjection 要素表坐标系对应的转换, 支持经纬度及web墨卡托
+func gpkgProjection(db *sql.DB, srs int) (orb.Projection, error) {
+	var org string
+	var id int
+	var def string
+	err := db.QueryRow("SELECT organization, organization_coordsys_id, definition FROM gpkg_spatial_ref_sys WHERE srs_id = ?", srs).Scan(&org, &id, &def)
+	if err != nil {
+		return nil, fmt.Errorf("read srs %d error: %s", srs, err)
+	}
+	if strings.EqualFold(org, "EPSG") {
+		switch id {
+		case 4326, 4490, 4258, 4269:
+			return nil, nil
+		case 3857, 900913:
+			return project.Mercator.ToWGS84, nil
+		}
+	}
+	if srs == 0 {
+		return nil, nil
+	}
+	return prjProjection(def)
+}
+
+// gpkgGeometry 解析GeoPackage几何, 跳过GP头及范围后按WKB解析, 空几何返回nil
+func gpkgGeometry(b []byte) (orb.Geometry, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if len(b) < 8 || b[0] != 'G' || b[1] != 'P' {
+		return nil, fmt.Errorf("invalid geopackage geometry")
+	}
+	flags := b[3]
+	if flags&0x10 != 0 {
+		return nil, nil
+	}
+	sizes := []int{0, 32, 48, 48, 64}
+	env := int(flags>>1) & 0x07
+	if env >= len(sizes) || len(b) < 8+sizes[env] {
+		return nil, fmt.Errorf("invalid geopackage geometry envelope")
+	}
+	r := &wkbReader{b: b[8+sizes[env]:]}
+	g := r.geometry()
+	return g, r.err
+}
+
+// wkbReader WKB解析, 支持ISO及EWKB的Z、M维度, 只保留x、y
+type wkbReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *wkbReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.off+n > len(r.b) {
+		r.err = fmt.Errorf("wkb is truncated")
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *wkbReader) geometry() orb.Geometry {
+	head := r.read(5)
+	if head == nil {
+		return nil
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if head[0] == 0 {
+		order = binary.BigEndian
+	}
+	typ := order.Uint32(head[1:])
+	dims := 2
+	if typ&0x80000000 != 0 {
+		dims++
+	}
+	if typ&0x40000000 != 0 {
+		dims++
+	}
+	if typ&0x20000000 != 0 { //EWKB SRID
+		r.read(4)
+	}
+	typ &= 0x0fffffff
+	switch typ / 1000 {
+	case 1, 2:
+		dims++
+	case 3:
+		dims += 2
+	}
+	typ %= 1000
+	//数量来自文件, 每项至少占size字节, 超出剩余长度时视为数据截断, 避免按损坏的数量分配内存
+	count := func(size int) int {
+		b := r.read(4)
+		if b == nil {
+			return 0
+		}
+		n := int(order.Uint32(b))
+		if n > (len(r.b)-r.off)/size {
+			r.err = fmt.Errorf("wkb is truncated")
+			return 0
+		}
+		return n
+	}
+	points := func(n int) []orb.Point {
+		if r.err != nil || n < 0 || n*8*dims > len(r.b)-r.off {
+			r.err = fmt.Errorf("wkb is truncated")
+			return nil
+		}
+		ps := make([]orb.Point, n)
+		for i := range ps {
+			b := r.read(8 * dims)
+			ps[i] = orb.Point{math.Float64frombits(order.Uint64(b)), math.Float64frombits(order.Uint64(b[8:]))}
+		}
+		return ps
+	}
+	switch typ {
+	case 1:
+		ps := points(1)
+		if ps == nil || math.IsNaN(ps[0][0]) { //空点
+			return nil
+		}
+		return ps[0]
+	case 2:
+		return orb.LineString(points(count(8 * dims)))
+	case 3:
+		n := count(4)
+		p := make(orb.Polygon, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			p = append(p, orb.Ring(points(count(8*dims))))
+		}
+		return p
+	case 4, 5, 6, 7:
+		n := count(5)
+		var c orb.Collection
+		for i := 0; i < n && r.err == nil; i++ {
+			if g := r.geometry(); g != nil {
+				c = append(c, g)
+			}
+		}
+		switch typ {
+		case 4:
+			mp := make(orb.MultiPoint, 0, len(c))
+			for _, g := range c {
+				if p, ok := g.(orb.Point); ok {
+					mp = append(mp, p)
+				}
+			}
+			return mp
+		case 5:
+			mls := make(orb.MultiLineString, 0, len(c))
+			for _, g := range c {
+				if ls, ok := g.(orb.LineString); ok {
+					mls = append(mls, ls)
+				}
+			}
+			return mls
+		case 6:
+			mp := make(orb.MultiPolygon, 0, len(c))
+			for _, g := range c {
+				if p, ok := g.(orb.Polygon); ok {
+					mp = append(mp, p)
+				}
+			}
+			return mp
+		}
+		return c
+	}
+	r.err = fmt.Errorf("unsupported wkb type %d", typ)
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/project"
+)
+
+// wkb 按字节序编码WKB, parts为uint32数量、float64坐标或嵌套的WKB
+func wkb(order binary.ByteOrder, typ uint32, parts ...interface{}) []byte {
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	binary.Write(&buf, order, typ)
+	for _, p := range parts {
+		if b, ok := p.([]byte); ok {
+			buf.Write(b)
+			continue
+		}
+		binary.Write(&buf, order, p)
+	}
+	return buf.Bytes()
+}
+
+// gp 加上不带范围的GeoPackage几何头
+func gp(srs int32, wkb []byte) []byte {
+	b := []byte{'G', 'P', 0, 0x01, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(b[4:], uint32(srs))
+	return append(b, wkb...)
+}
+
+func TestGpkgGeometry(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	square := []interface{}{uint32(5), 0.0, 0.0, 4.0, 0.0, 4.0, 4.0, 0.0, 4.0, 0.0, 0.0}
+	hole := []interface{}{uint32(4), 1.0, 1.0, 1.0, 2.0, 2.0, 1.0, 1.0, 1.0}
+	polygon := wkb(le, 3, append(append([]interface{}{uint32(2)}, square...), hole...)...)
+	cases := []struct {
+		name string
+		b    []byte
+		want orb.Geometry
+	}{
+		{"point", gp(4326, wkb(le, 1, 1.0, 2.0)), orb.Point{1, 2}},
+		{"point big endian", gp(4326, wkb(be, 1, 1.0, 2.0)), orb.Point{1, 2}},
+		{"empty point", gp(4326, wkb(le, 1, math.NaN(), math.NaN())), nil},
+		{"line iso z", gp(4326, wkb(le, 1002, uint32(2), 1.0, 2.0, 9.0, 3.0, 4.0, 9.0)), orb.LineString{{1, 2}, {3, 4}}},
+		{"line iso zm", gp(4326, wkb(le, 3002, uint32(1), 1.0, 2.0, 9.0, 8.0)), orb.LineString{{1, 2}}},
+		{"point ewkb srid z", gp(4326, wkb(le, 0xa0000001, uint32(4326), 1.0, 2.0, 9.0)), orb.Point{1, 2}},
+		{"polygon with hole", gp(4326, polygon), orb.Polygon{
+			{{0, 0}, {4, 0}, {4, 4}, {0, 4}, {0, 0}},
+			{{1, 1}, {1, 2}, {2, 1}, {1, 1}},
+		}},
+		{"multipoint", gp(4326, wkb(le, 4, uint32(2), wkb(le, 1, 1.0, 2.0), wkb(be, 1, 3.0, 4.0))), orb.MultiPoint{{1, 2}, {3, 4}}},
+		{"multiline", gp(4326, wkb(le, 5, uint32(1), wkb(le, 2, uint32(2), 1.0, 2.0, 3.0, 4.0))), orb.MultiLineString{{{1, 2}, {3, 4}}}},
+		{"multipolygon", gp(4326, wkb(le, 6, uint32(1), polygon)), orb.MultiPolygon{{
+			{{0, 0}, {4, 0}, {4, 4}, {0, 4}, {0, 0}},
+			{{1, 1}, {1, 2}, {2, 1}, {1, 1}},
+		}}},
+		{"collection", gp(4326, wkb(le, 7, uint32(2), wkb(le, 1, 1.0, 2.0), wkb(le, 2, uint32(2), 1.0, 2.0, 3.0, 4.0))),
+			orb.Collection{orb.Point{1, 2}, orb.LineString{{1, 2}, {3, 4}}}},
+		{"empty flag", []byte{'G', 'P', 0, 0x11, 0, 0, 0, 0}, nil},
+		{"null", nil, nil},
+	}
+	for _, c := range cases {
+		g, err := gpkgGeometry(c.b)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if c.want == nil {
+			if g != nil {
+				t.Errorf("%s: got %v, want nil", c.name, g)
+			}
+			continue
+		}
+		if g == nil || !orb.Equal(g, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, g, c.want)
+		}
+	}
+
+	//损坏的数据返回错误, 不按文件中的数量分配内存
+	bad := []struct {
+		name string
+		b    []byte
+		err  string
+	}{
+		{"not gp", []byte("XX\x00\x01\x00\x00\x00\x00"), "invalid geopackage geometry"},
+		{"bad envelope", []byte{'G', 'P', 0, 0x0f, 0, 0, 0, 0}, "envelope"},
+		{"short envelope", []byte{'G', 'P', 0, 0x03, 0, 0, 0, 0, 1}, "envelope"},
+		{"truncated point", gp(4326, wkb(le, 1, 1.0))[:20], "truncated"},
+		{"truncated header", gp(4326, []byte{1, 1, 0}), "truncated"},
+		{"huge line", gp(4326, wkb(le, 2, uint32(0xffffffff), 1.0, 2.0)), "truncated"},
+		{"huge rings", gp(4326, wkb(le, 3, append([]interface{}{uint32(0xffffffff)}, square...)...)), "truncated"},
+		{"huge ring points", gp(4326, wkb(le, 3, uint32(1), uint32(0xffffffff), 1.0, 2.0)), "truncated"},
+		{"huge multipolygon", gp(4326, wkb(le, 6, uint32(0xffffffff), polygon)), "truncated"},
+		{"huge collection", gp(4326, wkb(be, 7, uint32(0xfffffff0))), "truncated"},
+		{"unsupported", gp(4326, wkb(le, 17, 1.0)), "unsupported wkb type 17"},
+	}
+	for _, c := range bad {
+		_, err := gpkgGeometry(c.b)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+// writeGpkgFeatures 创建含两个要素表的GeoPackage
+func writeGpkgFeatures(t *testing.T, file string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	le := binary.LittleEndian
+	//范围头: 小端、xy范围
+	withEnvelope := func(w []byte) []byte {
+		b := []byte{'G', 'P', 0, 0x03, 0x11, 0x0f, 0, 0}
+		var env bytes.Buffer
+		binary.Write(&env, le, [4]float64{0, 1, 2, 3})
+		return append(append(b, env.Bytes()...), w...)
+	}
+	min, max := project.WGS84.ToMercator(orb.Point{118, 32}), project.WGS84.ToMercator(orb.Point{119, 33})
+	x, y, x2, y2 := min[0], min[1], max[0], max[1]
+	stmts := []struct {
+		q    string
+		args []interface{}
+	}{
+		{`create table gpkg_spatial_ref_sys (srs_name text, srs_id integer primary key, organization text, organization_coordsys_id integer, definition text)`, nil},
+		{`create table gpkg_contents (table_name text primary key, data_type text)`, nil},
+		{`create table gpkg_geometry_columns (table_name text, column_name text, geometry_type_name text, srs_id integer, z integer, m integer)`, nil},
+		{`insert into gpkg_spatial_ref_sys values ('WGS 84', 4326, 'EPSG', 4326, ''), ('Pseudo-Mercator', 3857, 'EPSG', 3857, '')`, nil},
+		{`insert into gpkg_contents values ('regions', 'features'), ('points', 'features'), ('tiles', 'tiles')`, nil},
+		{`insert into gpkg_geometry_columns values ('regions', 'geom', 'POLYGON', 3857, 0, 0), ('points', 'shape', 'POINT', 4326, 0, 0)`, nil},
+		{`create table regions (fid integer primary key, geom blob, name text, code integer)`, nil},
+		{`create table points (fid integer primary key, shape blob, name text)`, nil},
+		{`insert into regions (geom, name, code) values (?, '南京', 320100), (?, '空', 0), (null, '无', 1)`, []interface{}{
+			withEnvelope(wkb(le, 3, uint32(1), uint32(4), x, y, x2, y, x2, y2, x, y)),
+			[]byte{'G', 'P', 0, 0x11, 0, 0, 0, 0},
+		}},
+		{`insert into points (shape, name) values (?, 'a')`, []interface{}{gp(4326, wkb(le, 1, 118.5, 32.5))}},
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s.q, s.args...); err != nil {
+			t.Fatalf("%s: %s", s.q, err)
+		}
+	}
+}
+
+func TestLoadGpkgFeatures(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "regions.gpkg")
+	writeGpkgFeatures(t, file)
+
+	if _, err := loadGpkgFeatures(file, ""); err == nil || !strings.Contains(err.Error(), "set table") {
+		t.Errorf("two feature tables without table: %v, want an error asking for table", err)
+	}
+	if _, err := loadGpkgFeatures(file, "tiles"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("tile table: %v, want not found", err)
+	}
+
+	//表名不区分大小写, 墨卡托坐标转为经纬度, 空几何跳过
+	features, err := loadGpkgFeatures(file, "REGIONS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 1 {
+		t.Fatalf("features = %d, want 1", len(features))
+	}
+	f := features[0]
+	if f.Properties["name"] != "南京" || f.Properties["code"] != int64(320100) {
+		t.Errorf("properties = %v", f.Properties)
+	}
+	if _, ok := f.Properties["geom"]; ok {
+		t.Error("geometry column kept in properties")
+	}
+	p, ok := f.Geometry.(orb.Polygon)
+	if !ok || len(p) != 1 || len(p[0]) != 4 {
+		t.Fatalf("geometry = %v, want a triangle", f.Geometry)
+	}
+	for i, want := range []orb.Point{{118, 32}, {119, 32}, {119, 33}, {118, 32}} {
+		if math.Abs(p[0][i][0]-want[0]) > 1e-9 || math.Abs(p[0][i][1]-want[1]) > 1e-9 {
+			t.Errorf("point %d = %v, want %v", i, p[0][i], want)
+		}
+	}
+
+	c, err := loadRegion(file, "points", "name = 'a'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 1 || c[0] != (orb.Point{118.5, 32.5}) {
+		t.Errorf("region = %v, want the point", c)
+	}
+}
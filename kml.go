@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// kmlGeometry KML几何, MultiGeometry可嵌套
+type kmlGeometry struct {
+	Points      []string `xml:"Point>coordinates"`
+	LineStrings []string `xml:"LineString>coordinates"`
+	LinearRings []string `xml:"LinearRing>coordinates"`
+	Polygons    []struct {
+		Outer string   `xml:"outerBoundaryIs>LinearRing>coordinates"`
+		Inner []string `xml:"innerBoundaryIs>LinearRing>coordinates"`
+	} `xml:"Polygon"`
+	Multi []kmlGeometry `xml:"MultiGeometry"`
+}
+
+// kmlPlacemark KML要素, 属性取名称及ExtendedData
+type kmlPlacemark struct {
+	Name string `xml:"name"`
+	Data []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value"`
+	} `xml:"ExtendedData>Data"`
+	SimpleData []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"ExtendedData>SchemaData>SimpleData"`
+	kmlGeometry
+}
+
+// loadKML 读取KML或KMZ中的要素, KMZ取其中的doc.kml或第一个kml文件
+func loadKML(file string) ([]*geojson.Feature, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(path.Ext(file), ".kmz") {
+		data, err = kmzDocument(data)
+		if err != nil {
+			return nil, fmt.Errorf("read %s error: %s", file, err)
+		}
+	}
+	features, err := parseKML(data)
+	if err != nil {
+		return nil, fmt.Errorf("read %s error: %s", file, err)
+	}
+	return features, nil
+}
+
+// kmzDocument KMZ压缩包中的KML文档
+func kmzDocument(data []byte) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var doc *zip.File
+	for _, f := range zr.File {
+		if strings.EqualFold(f.Name, "doc.kml") {
+			doc = f
+			break
+		}
+		if doc == nil && strings.EqualFold(path.Ext(f.Name), ".kml") {
+			doc = f
+		}
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("no kml file in kmz")
+	}
+	rc, err := doc.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// parseKML 解析KML文档中任意层级Document、Folder下的Placemark
+func parseKML(data []byte) ([]*geojson.Feature, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var features []*geojson.Feature
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "Placemark" {
+			continue
+		}
+		var pm kmlPlacemark
+		if err := dec.DecodeElement(&pm, &se); err != nil {
+			return nil, err
+		}
+		g, err := pm.geometry()
+		if err != nil {
+			return nil, fmt.Errorf("placemark %q: %s", pm.Name, err)
+		}
+		if g == nil {
+			continue
+		}
+		f := geojson.NewFeature(g)
+		if pm.Name != "" {
+			f.Properties["name"] = strings.TrimSpace(pm.Name)
+		}
+		for _, d := range pm.Data {
+			f.Properties[d.Name] = strings.TrimSpace(d.Value)
+		}
+		for _, d := range pm.SimpleData {
+			f.Properties[d.Name] = strings.TrimSpace(d.Value)
+		}
+		features = append(features, f)
+	}
+	return features, nil
+}
+
+// geometry 几何, 同类几何合并为Multi类型, 不同类型时为Collection
+func (g kmlGeometry) geometry() (orb.Geometry, error) {
+	var points orb.MultiPoint
+	var lines orb.MultiLineString
+	var polygons orb.MultiPolygon
+	var others orb.Collection
+	for _, s := range g.Points {
+		ps, err := kmlCoordinates(s)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, ps...)
+	}
+	for _, s := range g.LineStrings {
+		ps, err := kmlCoordinates(s)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, orb.LineString(ps))
+	}
+	for _, s := range g.LinearRings {
+		ps, err := kmlCoordinates(s)
+		if err != nil {
+			return nil, err
+		}
+		polygons = append(polygons, orb.Polygon{orb.Ring(ps)})
+	}
+	for _, p := range g.Polygons {
+		outer, err := kmlCoordinates(p.Outer)
+		if err != nil {
+			return nil, err
+		}
+		polygon := orb.Polygon{orb.Ring(outer)}
+		for _, s := range p.Inner {
+			inner, err := kmlCoordinates(s)
+			if err != nil {
+				return nil, err
+			}
+			polygon = append(polygon, orb.Ring(inner))
+		}
+		polygons = append(polygons, polygon)
+	}
+	for _, m := range g.Multi {
+		sub, err := m.geometry()
+		if err != nil {
+			return nil, err
+		}
+		switch sub := sub.(type) {
+		case nil:
+		case orb.Point:
+			points = append(points, sub)
+		case orb.MultiPoint:
+			points = append(points, sub...)
+		case orb.LineString:
+			lines = append(lines, sub)
+		case orb.MultiLineString:
+			lines = append(lines, sub...)
+		case orb.Polygon:
+			polygons = append(polygons, sub)
+		case orb.MultiPolygon:
+			polygons = append(polygons, sub...)
+		default:
+			others = append(others, sub)
+		}
+	}
+	var c orb.Collection
+	switch len(points) {
+	case 0:
+	case 1:
+		c = append(c, points[0])
+	default:
+		c = append(c, points)
+	}
+	switch len(lines) {
+	case 0:
+	case 1:
+		c = append(c, lines[0])
+	default:
+		c = append(c, lines)
+	}
+	switch len(polygons) {
+	case 0:
+	case 1:
+		c = append(c, polygons[0])
+	default:
+		c = append(c, polygons)
+	}
+	c = append(c, others...)
+	switch len(c) {
+	case 0:
+		return nil, nil
+	case 1:
+		return c[0], nil
+	}
+	return c, nil
+}
+
+// kmlCoordinates 解析"lon,lat[,alt]"以空白分隔的坐标
+func kmlCoordinates(s string) ([]orb.Point, error) {
+	var points []orb.Point
+	for _, tuple := range strings.Fields(s) {
+		parts := strings.Split(tuple, ",")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid coordinates %q", tuple)
+		}
+		lon, err1 := strconv.ParseFloat(parts[0], 64)
+		lat, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid coordinates %q", tuple)
+		}
+		points = append(points, orb.Point{lon, lat})
+	}
+	return points, nil
+}
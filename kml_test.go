@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+const testKML = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2">
+<Document>
+	<name>regions</name>
+	<Folder>
+		<Placemark>
+			<name> 南京市 </name>
+			<ExtendedData>
+				<Data name="adcode"><value>320100</value></Data>
+				<SchemaData schemaUrl="#s"><SimpleData name="level">city</SimpleData></SchemaData>
+			</ExtendedData>
+			<Polygon>
+				<outerBoundaryIs><LinearRing><coordinates>
+					118,31,0 120,31,0 120,33,0 118,33,0 118,31,0
+				</coordinates></LinearRing></outerBoundaryIs>
+				<innerBoundaryIs><LinearRing><coordinates>118.5,31.5 118.5,32.5 119.5,32.5 118.5,31.5</coordinates></LinearRing></innerBoundaryIs>
+			</Polygon>
+		</Placemark>
+		<Folder>
+			<Placemark>
+				<name>stations</name>
+				<MultiGeometry>
+					<Point><coordinates>118.8,32.1</coordinates></Point>
+					<Point><coordinates>118.9,32.2</coordinates></Point>
+					<LineString><coordinates>118.8,32.1 118.9,32.2</coordinates></LineString>
+				</MultiGeometry>
+			</Placemark>
+		</Folder>
+		<Placemark>
+			<name>no geometry</name>
+		</Placemark>
+	</Folder>
+</Document>
+</kml>`
+
+func TestParseKML(t *testing.T) {
+	features, err := parseKML([]byte(testKML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 2 {
+		t.Fatalf("features = %d, want 2", len(features))
+	}
+	p := features[0].Properties
+	if p["name"] != "南京市" || p["adcode"] != "320100" || p["level"] != "city" {
+		t.Errorf("properties = %v", p)
+	}
+	polygon := orb.Polygon{
+		{{118, 31}, {120, 31}, {120, 33}, {118, 33}, {118, 31}},
+		{{118.5, 31.5}, {118.5, 32.5}, {119.5, 32.5}, {118.5, 31.5}},
+	}
+	if !orb.Equal(features[0].Geometry, polygon) {
+		t.Errorf("polygon = %v, want %v", features[0].Geometry, polygon)
+	}
+	//同类几何合并, 不同类型组成集合
+	multi := orb.Collection{
+		orb.MultiPoint{{118.8, 32.1}, {118.9, 32.2}},
+		orb.LineString{{118.8, 32.1}, {118.9, 32.2}},
+	}
+	if !orb.Equal(features[1].Geometry, multi) {
+		t.Errorf("multi geometry = %v, want %v", features[1].Geometry, multi)
+	}
+
+	bad := []struct {
+		name string
+		kml  string
+		err  string
+	}{
+		{"coordinates", `<kml><Placemark><Point><coordinates>118</coordinates></Point></Placemark></kml>`, "invalid coordinates"},
+		{"number", `<kml><Placemark><Point><coordinates>a,b</coordinates></Point></Placemark></kml>`, "invalid coordinates"},
+		{"xml", `<kml><Placemark><Point>`, "EOF"},
+	}
+	for _, c := range bad {
+		_, err := parseKML([]byte(c.kml))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+// writeKMZ 写出包含若干文件的KMZ
+func writeKMZ(t *testing.T, file string, files map[string]string, order []string) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range order {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[name]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadKML(t *testing.T) {
+	dir := t.TempDir()
+	kml := filepath.Join(dir, "regions.kml")
+	os.WriteFile(kml, []byte(testKML), 0644)
+	c, err := loadRegion(kml, "", "level = 'city'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 1 {
+		t.Errorf("region = %v, want the polygon", c)
+	}
+
+	//KMZ优先读取doc.kml, 否则取第一个kml文件
+	other := `<kml><Placemark><name>other</name><Point><coordinates>1,2</coordinates></Point></Placemark></kml>`
+	files := map[string]string{"files/a.kml": other, "doc.kml": testKML, "images/a.png": "png"}
+	kmz := filepath.Join(dir, "regions.KMZ")
+	writeKMZ(t, kmz, files, []string{"images/a.png", "files/a.kml", "doc.kml"})
+	features, err := loadKML(kmz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 2 || features[0].Properties["name"] != "南京市" {
+		t.Errorf("kmz features = %d, want doc.kml", len(features))
+	}
+	writeKMZ(t, kmz, files, []string{"images/a.png", "files/a.kml"})
+	features, err = loadKML(kmz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 1 || features[0].Properties["name"] != "other" {
+		t.Errorf("kmz without doc.kml: features = %v, want files/a.kml", features)
+	}
+	writeKMZ(t, kmz, files, []string{"images/a.png"})
+	if _, err := loadKML(kmz); err == nil || !strings.Contains(err.Error(), "no kml file") {
+		t.Errorf("kmz without kml: %v", err)
+	}
+	os.WriteFile(kmz, []byte(testKML), 0644)
+	if _, err := loadKML(kmz); err == nil {
+		t.Error("plain kml named .kmz read without error")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/paulmach/orb/maptile"
+	log "github.com/sirupsen/logrus"
+)
+
+// TileState 瓦片下载状态
+type TileState int
+
+// Constants representing tile states in the ledger
+const (
+	TilePending TileState = iota // 已派发，尚未保存
+	TileDone                     // 已保存
+	TileFailed                   // 下载或保存失败
+)
+
+// LedgerBatchSize 账本批量写入大小
+const LedgerBatchSize = 1 << 10
+
+// TileData 瓦片状态记录
+type TileData struct {
+	Z     int
+	X     int
+	Y     int
+	State TileState
+}
+
+// Ledger 任务瓦片状态账本, 记录每个瓦片的下载状态以支持断点续传
+type Ledger struct {
+	File    string
+	db      *sql.DB
+	records chan TileData
+	done    chan struct{}
+}
+
+// OpenLedger 打开或创建账本, 单连接串行读写, 锁等待超时5秒
+func OpenLedger(file string) (*Ledger, error) {
+	db, err := sql.Open("sqlite3", file+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("create table if not exists tiles (z integer, x integer, y integer, state integer, primary key (z, x, y)) without rowid;")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	l := &Ledger{
+		File:    file,
+		db:      db,
+		records: make(chan TileData, LedgerBatchSize),
+		done:    make(chan struct{}),
+	}
+	go l.writeLoop()
+	return l, nil
+}
+
+// Record 记录瓦片状态
+func (l *Ledger) Record(t maptile.Tile, state TileState) {
+	l.records <- TileData{Z: int(t.Z), X: int(t.X), Y: int(t.Y), State: state}
+}
+
+// DoneSet 获取指定层级已完成的瓦片集
+func (l *Ledger) DoneSet(z int) (maptile.Set, error) {
+	rows, err := l.db.Query("select x, y from tiles where z = ? and state = ?", z, TileDone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	set := make(maptile.Set)
+	for rows.Next() {
+		var x, y uint32
+		if err := rows.Scan(&x, &y); err != nil {
+			return nil, err
+		}
+		set[maptile.New(x, y, maptile.Zoom(z))] = true
+	}
+	return set, rows.Err()
+}
+
+// Count 统计各状态瓦片数
+func (l *Ledger) Count() (map[TileState]int64, error) {
+	rows, err := l.db.Query("select state, count(*) from tiles group by state")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	info := make(map[TileState]int64)
+	for rows.Next() {
+		var state TileState
+		var cnt int64
+		if err := rows.Scan(&state, &cnt); err != nil {
+			return nil, err
+		}
+		info[state] = cnt
+	}
+	return info, rows.Err()
+}
+
+// Close 写入剩余记录并关闭账本
+func (l *Ledger) Close() error {
+	close(l.records)
+	<-l.done
+	return l.db.Close()
+}
+
+// writeLoop 批量写入瓦片状态, 满批次或定时提交事务
+func (l *Ledger) writeLoop() {
+	defer close(l.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	batch := make([]TileData, 0, LedgerBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := l.commit(batch)
+		if err != nil {
+			log.Errorf("write ledger %s error ~ %s", l.File, err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case r, ok := <-l.records:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) >= LedgerBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// commit 使用事务批量写入
+func (l *Ledger) commit(tiles []TileData) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = insertTiles(tx, tiles)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// 插入瓦片数据
+func insertTiles(db *sql.Tx, tiles []TileData) error {
+	// 准备插入语句
+	stmt, err := db.Prepare("insert or replace into tiles (z, x, y, state) values (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// 执行插入
+	for _, tile := range tiles {
+		_, err = stmt.Exec(tile.Z, tile.X, tile.Y, tile.State)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/spf13/viper"
+)
+
+func TestLedgerRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "t.ledger")
+	l, err := OpenLedger(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiles := []maptile.Tile{maptile.New(0, 0, 2), maptile.New(1, 0, 2), maptile.New(2, 0, 2), maptile.New(0, 0, 1)}
+	for _, tile := range tiles {
+		l.Record(tile, TilePending)
+	}
+	//派发后保存或失败, 后写入的状态覆盖之前的
+	l.Record(tiles[0], TileDone)
+	l.Record(tiles[1], TileFailed)
+	l.Record(tiles[3], TileDone)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = OpenLedger(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	info, err := l.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[TileState]int64{TileDone: 2, TilePending: 1, TileFailed: 1}
+	for state, n := range want {
+		if info[state] != n {
+			t.Errorf("state %d count = %d, want %d", state, info[state], n)
+		}
+	}
+	done, err := l.DoneSet(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 || !done[tiles[0]] {
+		t.Errorf("done set of zoom 2 = %v, want only %v", done, tiles[0])
+	}
+}
+
+// tileServer 返回PNG瓦片并记录请求的路径
+type tileServer struct {
+	sync.Mutex
+	body  []byte
+	paths map[string]int
+}
+
+func newTileServer() *tileServer {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	return &tileServer{body: buf.Bytes(), paths: make(map[string]int)}
+}
+
+func (s *tileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.paths[r.URL.Path]++
+	s.Unlock()
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(s.body)
+}
+
+// setTestConfig 写入配置文件并按命令行的方式加载
+func setTestConfig(t *testing.T, conf string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "conf.toml")
+	if err := os.WriteFile(file, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	initConf(file)
+	t.Cleanup(viper.Reset)
+}
+
+func TestTaskResumeLedger(t *testing.T) {
+	srv := newTileServer()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	out := filepath.Join(t.TempDir(), "out")
+	setTestConfig(t, `
+[output]
+	format = "file"
+	file = "`+filepath.ToSlash(out)+`"
+[task]
+	workers = 2
+`)
+	tiles := []maptile.Tile{maptile.New(0, 0, 2), maptile.New(1, 0, 2), maptile.New(2, 0, 2), maptile.New(3, 0, 2)}
+	m := TileMap{Name: "t", Min: 2, Max: 2, Format: PNG, URL: ts.URL + "/{z}/{x}/{y}.png"}
+	task, err := NewTask([]Layer{{Zoom: 2, Tiles: tiles}}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.File, err = task.outputFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//上次运行中断: 两个瓦片已保存, 一个已派发未保存
+	l, err := OpenLedger(task.File + ".ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(tiles[0], TileDone)
+	l.Record(tiles[1], TileDone)
+	l.Record(tiles[2], TilePending)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	task.resume = true
+	task.Download()
+	if task.State() != taskStates[TaskFinished] {
+		t.Fatalf("task state = %s, want finished", task.State())
+	}
+	for _, p := range []string{"/2/0/0.png", "/2/1/0.png"} {
+		if srv.paths[p] != 0 {
+			t.Errorf("done tile %s fetched again", p)
+		}
+	}
+	for _, p := range []string{"/2/2/0.png", "/2/3/0.png"} {
+		if srv.paths[p] != 1 {
+			t.Errorf("tile %s fetched %d times, want 1", p, srv.paths[p])
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "2", "3", "0.png")); err != nil {
+		t.Errorf("tile not saved: %s", err)
+	}
+	//全部完成后删除账本
+	if _, err := os.Stat(task.File + ".ledger"); !os.IsNotExist(err) {
+		t.Errorf("ledger not removed after success: %v", err)
+	}
+}
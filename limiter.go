@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Limiter 令牌桶限速器
+type Limiter struct {
+	sync.Mutex
+	base   float64 //配置的每秒请求数
+	rate   float64 //当前每秒请求数, 自适应时低于base
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time //时钟, 测试时替换
+}
+
+// NewLimiter 创建令牌桶, rate为每秒请求数, burst为突发请求数
+func NewLimiter(rate float64, burst int) *Limiter {
+	return newLimiter(rate, burst, time.Now)
+}
+
+func newLimiter(rate float64, burst int, now func() time.Time) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		base:   rate,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now(),
+		now:    now,
+	}
+}
+
+// reserve 取出一个令牌, 返回令牌可用前需等待的时间
+func (l *Limiter) reserve() time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait 获取一个令牌, 令牌不足时等待, 任务取消时返回错误
+func (l *Limiter) Wait(ctx context.Context) error {
+	wait := l.reserve()
+	if wait == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SlowDown 服务端限流时减半速率, 最低为配置的1/32
+func (l *Limiter) SlowDown() float64 {
+	l.Lock()
+	defer l.Unlock()
+	l.rate = math.Max(l.rate/2, l.base/32)
+	return l.rate
+}
+
+// Recover 请求成功时逐步恢复速率
+func (l *Limiter) Recover() {
+	l.Lock()
+	l.rate = math.Min(l.base, l.rate+l.base/100)
+	l.Unlock()
+}
+
+// RateLimiter 全局及按主机限速
+type RateLimiter struct {
+	sync.Mutex
+	global    *Limiter
+	hostRate  float64
+	hostBurst int
+	hosts     map[string]*Limiter
+	adaptive  bool
+	now       func() time.Time
+}
+
+// NewRateLimiter 从配置创建限速器
+func NewRateLimiter() *RateLimiter {
+	rl := &RateLimiter{
+		hostRate:  viper.GetFloat64("task.hostrate"),
+		hostBurst: viper.GetInt("task.hostburst"),
+		hosts:     make(map[string]*Limiter),
+		adaptive:  viper.GetBool("task.adaptive"),
+		now:       time.Now,
+	}
+	if rate := viper.GetFloat64("task.rate"); rate > 0 {
+		rl.global = newLimiter(rate, viper.GetInt("task.burst"), rl.now)
+	}
+	return rl
+}
+
+// host 主机限速器, 未配置按主机限速时返回nil
+func (rl *RateLimiter) host(tile string) *Limiter {
+	if rl.hostRate <= 0 {
+		return nil
+	}
+	u, err := url.Parse(tile)
+	if err != nil {
+		return nil
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	l, ok := rl.hosts[u.Host]
+	if !ok {
+		l = newLimiter(rl.hostRate, rl.hostBurst, rl.now)
+		rl.hosts[u.Host] = l
+	}
+	return l
+}
+
+// Wait 请求前等待全局及主机令牌
+func (rl *RateLimiter) Wait(ctx context.Context, tile string) error {
+	if rl.global != nil {
+		if err := rl.global.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if l := rl.host(tile); l != nil {
+		return l.Wait(ctx)
+	}
+	return nil
+}
+
+// Feedback 根据请求结果自适应调整速率, 429/503时降速, 成功时恢复
+func (rl *RateLimiter) Feedback(tile string, err error) {
+	if !rl.adaptive {
+		return
+	}
+	l := rl.host(tile)
+	if l == nil {
+		l = rl.global
+	}
+	if l == nil {
+		return
+	}
+	if err == nil {
+		l.Recover()
+		return
+	}
+	se, ok := err.(*StatusError)
+	if ok && (se.Code == http.StatusTooManyRequests || se.Code == http.StatusServiceUnavailable) {
+		rate := l.SlowDown()
+		log.Warnf("server busy (%d), slow down to %.2f req/s ~", se.Code, rate)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// fakeClock 手动推进的时钟
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// reserveAll 连续取n个令牌, 返回各自的等待时间
+func reserveAll(l *Limiter, n int) []time.Duration {
+	waits := make([]time.Duration, n)
+	for i := range waits {
+		waits[i] = l.reserve()
+	}
+	return waits
+}
+
+func equalWaits(a, b []time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	clk := newFakeClock()
+	l := newLimiter(10, 3, clk.Now)
+
+	//突发3个不等待, 之后按每秒10个排队
+	ms := time.Millisecond
+	want := []time.Duration{0, 0, 0, 100 * ms, 200 * ms}
+	if got := reserveAll(l, 5); !equalWaits(got, want) {
+		t.Fatalf("burst waits = %v, want %v", got, want)
+	}
+
+	//已预支2个令牌, 0.45秒补充4.5个, 剩余2.5个
+	clk.Advance(450 * ms)
+	want = []time.Duration{0, 0, 50 * ms}
+	if got := reserveAll(l, 3); !equalWaits(got, want) {
+		t.Fatalf("refill waits = %v, want %v", got, want)
+	}
+
+	//长时间空闲后令牌不超过burst
+	clk.Advance(time.Hour)
+	want = []time.Duration{0, 0, 0, 100 * ms}
+	if got := reserveAll(l, 4); !equalWaits(got, want) {
+		t.Fatalf("idle waits = %v, want %v", got, want)
+	}
+}
+
+func TestLimiterBurstMin(t *testing.T) {
+	clk := newFakeClock()
+	l := newLimiter(2, 0, clk.Now)
+	want := []time.Duration{0, 500 * time.Millisecond}
+	if got := reserveAll(l, 2); !equalWaits(got, want) {
+		t.Errorf("burst 0 waits = %v, want %v", got, want)
+	}
+}
+
+func TestLimiterWaitCanceled(t *testing.T) {
+	clk := newFakeClock()
+	l := newLimiter(1, 1, clk.Now)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := l.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := l.Wait(ctx); err != context.Canceled {
+		t.Errorf("wait after cancel = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRateLimiterHosts(t *testing.T) {
+	clk := newFakeClock()
+	rl := &RateLimiter{
+		global:    newLimiter(100, 100, clk.Now),
+		hostRate:  1,
+		hostBurst: 1,
+		hosts:     make(map[string]*Limiter),
+		now:       clk.Now,
+	}
+	a1, a2 := "http://a.t/1/0/0.png", "http://a.t/1/1/0.png"
+	b1 := "http://b.t/1/0/0.png"
+	if w := rl.host(a1).reserve(); w != 0 {
+		t.Errorf("first a wait = %v, want 0", w)
+	}
+	//同一主机共享令牌桶, 不同主机互不影响
+	if w := rl.host(a2).reserve(); w != time.Second {
+		t.Errorf("second a wait = %v, want 1s", w)
+	}
+	if w := rl.host(b1).reserve(); w != 0 {
+		t.Errorf("first b wait = %v, want 0", w)
+	}
+	if len(rl.hosts) != 2 {
+		t.Errorf("hosts = %d, want 2", len(rl.hosts))
+	}
+
+	rl.hostRate = 0
+	if l := rl.host(a1); l != nil {
+		t.Errorf("host limiter without hostrate = %v, want nil", l)
+	}
+}
+
+func TestRateLimiterAdaptive(t *testing.T) {
+	clk := newFakeClock()
+	rl := &RateLimiter{
+		global:   newLimiter(64, 1, clk.Now),
+		hosts:    make(map[string]*Limiter),
+		adaptive: true,
+		now:      clk.Now,
+	}
+	tile := "http://a.t/1/0/0.png"
+	l := rl.global
+
+	//429、503时减半
+	rl.Feedback(tile, &StatusError{Code: 429})
+	if l.rate != 32 {
+		t.Fatalf("rate after 429 = %v, want 32", l.rate)
+	}
+	rl.Feedback(tile, &StatusError{Code: 503})
+	if l.rate != 16 {
+		t.Fatalf("rate after 503 = %v, want 16", l.rate)
+	}
+	//减速后令牌补充变慢
+	want := []time.Duration{0, time.Second / 16}
+	if got := reserveAll(l, 2); !equalWaits(got, want) {
+		t.Errorf("waits at 16 req/s = %v, want %v", got, want)
+	}
+
+	//其他错误不影响速率
+	rl.Feedback(tile, &StatusError{Code: 404})
+	rl.Feedback(tile, errors.New("connection reset"))
+	if l.rate != 16 {
+		t.Fatalf("rate after other errors = %v, want 16", l.rate)
+	}
+
+	//最低降到配置的1/32
+	for i := 0; i < 10; i++ {
+		rl.Feedback(tile, &StatusError{Code: 429})
+	}
+	if l.rate != 2 {
+		t.Fatalf("rate floor = %v, want 2", l.rate)
+	}
+
+	//每次成功恢复配置的1/100, 不超过配置
+	for i := 0; i < 50; i++ {
+		rl.Feedback(tile, nil)
+	}
+	if math.Abs(l.rate-(2+50*0.64)) > 1e-9 {
+		t.Errorf("rate after 50 successes = %v, want %v", l.rate, 2+50*0.64)
+	}
+	for i := 0; i < 100; i++ {
+		rl.Feedback(tile, nil)
+	}
+	if l.rate != 64 {
+		t.Errorf("rate after recovery = %v, want 64", l.rate)
+	}
+}
+
+func TestRateLimiterAdaptiveHost(t *testing.T) {
+	clk := newFakeClock()
+	rl := &RateLimiter{
+		global:    newLimiter(64, 1, clk.Now),
+		hostRate:  8,
+		hostBurst: 1,
+		hosts:     make(map[string]*Limiter),
+		adaptive:  true,
+		now:       clk.Now,
+	}
+	//配置按主机限速时只降低该主机的速率
+	rl.Feedback("http://a.t/1/0/0.png", &StatusError{Code: 429})
+	if r := rl.host("http://a.t/").rate; r != 4 {
+		t.Errorf("a rate = %v, want 4", r)
+	}
+	if r := rl.host("http://b.t/").rate; r != 8 {
+		t.Errorf("b rate = %v, want 8", r)
+	}
+	if rl.global.rate != 64 {
+		t.Errorf("global rate = %v, want 64", rl.global.rate)
+	}
+
+	//未开启自适应时不调整
+	rl.adaptive = false
+	rl.Feedback("http://b.t/1/0/0.png", &StatusError{Code: 429})
+	if r := rl.host("http://b.t/").rate; r != 8 {
+		t.Errorf("b rate without adaptive = %v, want 8", r)
+	}
+}
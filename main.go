@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"flag"
 	"fmt"
 	"os"
@@ -12,6 +11,8 @@ import (
 
 	nested "github.com/antonfisher/nested-logrus-formatter"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
 	"github.com/spf13/viper"
 )
 
@@ -19,11 +20,15 @@ import (
 var (
 	hf bool
 	cf string
+	rf string
+	ff string
 )
 
 func init() {
 	flag.BoolVar(&hf, "h", false, "this help")
 	flag.StringVar(&cf, "c", "conf.toml", "set config `file`")
+	flag.StringVar(&rf, "resume", "", "resume the task with `taskID`, skip tiles already done")
+	flag.StringVar(&ff, "failed", "", "only fetch tiles listed in the failed tiles `file`")
 	// 改变默认的 Usage，flag包中的Usage 其实是一个函数类型。这里是覆盖默认函数实现，具体见后面Usage部分的分析
 	flag.Usage = usage
 	//InitLog 初始化日志
@@ -39,7 +44,8 @@ func init() {
 }
 func usage() {
 	fmt.Fprintf(os.Stderr, `tiler version: tiler/v0.1.0
-Usage: tiler [-h] [-c filename]
+Usage: tiler [-h] [-c filename] [-resume taskID] [-failed filename]
+       tiler [-c filename] serve
 `)
 	flag.PrintDefaults()
 }
@@ -60,108 +66,32 @@ func initConf(cfgFile string) {
 	viper.SetDefault("app.title", "MapCloud Tiler")
 	viper.SetDefault("output.format", "mbtiles")
 	viper.SetDefault("output.directory", "output")
+	viper.SetDefault("output.schema", "xyz")
+	viper.SetDefault("output.dedupe", false)
+	viper.SetDefault("output.mode", "overwrite")
+	viper.SetDefault("output.batchsize", 1000)
+	viper.SetDefault("output.flushinterval", 1000)
+	viper.SetDefault("output.s3.region", "us-east-1")
+	viper.SetDefault("output.s3.pathstyle", true)
+	viper.SetDefault("output.s3.concurrency", 16)
+	viper.SetDefault("output.encode.quality", 85)
+	viper.SetDefault("output.clip.fill", "#ffffff")
 	viper.SetDefault("task.workers", 4)
 	viper.SetDefault("task.savepipe", 1)
 	viper.SetDefault("task.timedelay", 0)
-}
-
-type TileData struct {
-	Z    int
-	X    int
-	Y    int
-	Flag bool
-}
-
-// 插入瓦片数据
-func insertTiles(db *sql.Tx, tiles []TileData) error {
-	// 准备插入语句
-	stmt, err := db.Prepare("INSERT INTO tiles (z, x, y,flag) VALUES (?, ?, ?, ?)")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	// 执行插入
-	for _, tile := range tiles {
-		_, err = stmt.Exec(tile.Z, tile.X, tile.Y, tile.Flag)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func testDbTask() {
-
-	db, err := sql.Open("sqlite3", "./tiles.db")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-
-	createTableSQL := `CREATE TABLE IF NOT EXISTS tiles (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		z INTEGER,
-		x INTEGER,
-		y INTEGER,
-		flag BOOLEAN
-	);`
-
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// 开始事务
-	tx, err := db.Begin()
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer tx.Rollback() // 如果提交事务前发生错误，则回滚事务
-
-	batchSize := 1 << 10
-	// 插入数据
-	tileBatch := make([]TileData, 0, batchSize)
-	total := 0
-	i := 0
-	for z := 0; z <= 12; z++ {
-		numTiles := 1 << uint(z) // 计算每个缩放级别的瓦片数量
-		total += numTiles * numTiles
-		log.Printf("级别%d,瓦片数量：%d\n", z, numTiles*numTiles)
-		log.Printf("总瓦片数量：%d\n", total)
-		for x := 0; x < numTiles; x++ {
-			for y := 0; y < numTiles; y++ {
-				tile := TileData{Z: z, X: x, Y: y, Flag: false}
-				tileBatch = append(tileBatch, tile)
-				// 批量插入
-				if len(tileBatch) >= batchSize {
-					err := insertTiles(tx, tileBatch) // 使用事务执行批量插入操作
-					if err != nil {
-						log.Fatal(err)
-					}
-					tileBatch = nil // 清空批次
-				}
-				i++
-				if i > 99999999 {
-					goto last
-				}
-			}
-
-		}
-	}
-last:
-	// 处理剩余的批次
-	if len(tileBatch) > 0 {
-		err := insertTiles(tx, tileBatch) // 使用事务执行批量插入操作
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	// 提交事务
-	err = tx.Commit()
-	if err != nil {
-		log.Fatal(err)
-	}
+	viper.SetDefault("tm.timeout", 30000)
+	viper.SetDefault("task.rate", 0)
+	viper.SetDefault("task.burst", 1)
+	viper.SetDefault("task.hostrate", 0)
+	viper.SetDefault("task.hostburst", 1)
+	viper.SetDefault("task.adaptive", false)
+	viper.SetDefault("task.retries", 3)
+	viper.SetDefault("task.backoff", 500)
+	viper.SetDefault("task.backoffmax", 30000)
+	viper.SetDefault("task.retrycodes", []int{429, 500, 502, 503, 504})
+	viper.SetDefault("task.blank.action", "drop")
+	viper.SetDefault("server.addr", ":8080")
+	viper.SetDefault("server.workers", 16)
 }
 
 func main() {
@@ -175,21 +105,53 @@ func main() {
 		cf = "conf.toml"
 	}
 	initConf(cf)
+	if flag.Arg(0) == "serve" {
+		serve()
+		return
+	}
 	start := time.Now()
+	insecure := viper.GetBool("tm.insecure")
 	tm := TileMap{
-		Name:   viper.GetString("tm.name"),
-		Min:    viper.GetInt("tm.min"),
-		Max:    viper.GetInt("tm.max"),
-		Format: viper.GetString("tm.format"),
-		Schema: viper.GetString("tm.schema"),
-		JSON:   viper.GetString("tm.json"),
-		URL:    viper.GetString("tm.url"),
+		Name:         viper.GetString("tm.name"),
+		Min:          viper.GetInt("tm.min"),
+		Max:          viper.GetInt("tm.max"),
+		Format:       viper.GetString("tm.format"),
+		Schema:       viper.GetString("tm.schema"),
+		JSON:         viper.GetString("tm.json"),
+		URL:          viper.GetString("tm.url"),
+		Subdomains:   viper.GetStringSlice("tm.subdomains"),
+		Balance:      viper.GetString("tm.balance"),
+		MatrixPrefix: viper.GetString("tm.matrixprefix"),
+		Source: Source{
+			Headers:  viper.GetStringMapString("tm.headers"),
+			Cookie:   viper.GetString("tm.cookie"),
+			Proxy:    viper.GetString("tm.proxy"),
+			Insecure: &insecure,
+			Timeout:  viper.GetInt("tm.timeout"),
+		},
 	}
 	type cfgLayer struct {
-		Min     int
-		Max     int
-		Geojson string
-		URL     string
+		Min          int
+		Max          int
+		Geojson      string
+		Table        string
+		Where        string
+		Bbox         []float64
+		Tiles        []string
+		Center       []float64
+		Radius       string
+		Buffer       string
+		Simplify     string
+		URL          string
+		Subdomains   []string
+		Balance      string
+		MatrixPrefix string
+		Schema       string
+		Headers      map[string]string
+		Cookie       string
+		Proxy        string
+		Insecure     *bool
+		Timeout      int
 	}
 	var cfgLrs []cfgLayer
 	err := viper.UnmarshalKey("lrs", &cfgLrs)
@@ -198,19 +160,94 @@ func main() {
 	}
 	var layers []Layer
 	for _, lrs := range cfgLrs {
+		//该层单独配置的请求参数, 未配置项继承tm
+		var src *Source
+		lsrc := Source{
+			Headers:  lrs.Headers,
+			Cookie:   lrs.Cookie,
+			Proxy:    lrs.Proxy,
+			Insecure: lrs.Insecure,
+			Timeout:  lrs.Timeout,
+		}
+		if !lsrc.Empty() {
+			lsrc.Inherit(&tm.Source)
+			src = &lsrc
+		}
+		//范围可为geojson、bbox、tiles或center+radius
+		region := Region{Bbox: lrs.Bbox, Tiles: lrs.Tiles, Center: lrs.Center, Radius: lrs.Radius}
+		var load func() (orb.Collection, error)
+		if lrs.Geojson != "" {
+			path, table, where := lrs.Geojson, lrs.Table, lrs.Where
+			load = func() (orb.Collection, error) {
+				return loadRegion(path, table, where)
+			}
+		} else if lrs.Where != "" {
+			log.Fatalf("lrs %d-%d where requires geojson ~", lrs.Min, lrs.Max)
+		}
+		c, ranges, err := region.Build(load)
+		if err != nil {
+			log.Fatalf("lrs %d-%d region error ~ %s", lrs.Min, lrs.Max, err)
+		}
+		buffer, err := parseDistance(lrs.Buffer)
+		if err != nil {
+			log.Fatalf("lrs buffer error ~ %s", err)
+		}
+		simplify, err := parseDistance(lrs.Simplify)
+		if err != nil {
+			log.Fatalf("lrs simplify error ~ %s", err)
+		}
 		for z := lrs.Min; z <= lrs.Max; z++ {
-			c := loadCollection(lrs.Geojson)
 			layer := Layer{
-				URL:        lrs.URL,
-				Zoom:       z,
-				Collection: c,
+				URL:          lrs.URL,
+				Zoom:         z,
+				Collection:   c,
+				Ranges:       rangesAt(ranges, maptile.Zoom(z)),
+				Source:       src,
+				Subdomains:   lrs.Subdomains,
+				Balance:      lrs.Balance,
+				MatrixPrefix: lrs.MatrixPrefix,
+				Schema:       lrs.Schema,
+				Buffer:       buffer,
+				Simplify:     simplify,
 			}
 			layers = append(layers, layer)
 		}
 	}
-	task := NewTask(layers, tm)
-	fmt.Println(task.workerCount)
+	//只下载失败瓦片, 图层范围不变, 裁剪仍按原轮廓
+	if ff != "" {
+		list, err := loadTileList(ff)
+		if err != nil {
+			log.Fatalf("load failed tiles %s error ~ %s", ff, err)
+		}
+		var failed []Layer
+		for _, layer := range layers {
+			if len(list[layer.Zoom]) == 0 {
+				continue
+			}
+			layer.Tiles = list[layer.Zoom]
+			delete(list, layer.Zoom)
+			failed = append(failed, layer)
+		}
+		for z, tiles := range list {
+			log.Warnf("%d failed tiles of zoom %d are not in lrs, skipped ~", len(tiles), z)
+		}
+		layers = failed
+	}
+	task, err := NewTask(layers, tm)
+	if err != nil {
+		log.Fatalf("create task error ~ %s", err)
+	}
+	//下载前检查输出模式
+	if _, err := task.outputFile(); err != nil {
+		log.Fatalf("create task error ~ %s", err)
+	}
+	if rf != "" {
+		task.ID = rf
+		task.resume = true
+	}
+	stop := watchSignals(task)
 	task.Download()
+	stop()
 	secs := time.Since(start).Seconds()
 	log.Printf("\n%.3fs finished...", secs)
 }
@@ -2,25 +2,26 @@ package main
 
 import (
 	"fmt"
-	"strconv"
-	"strings"
 
 	"github.com/paulmach/orb/maptile"
 )
 
 // TileMap 瓦片地图类型
 type TileMap struct {
-	ID          int
-	Name        string
-	Description string
-	Schema      string //no types,maybe "xyz" or "tms"
-	Min         int
-	Max         int
-	Format      string
-	JSON        string
-	URL         string
-	Token       string
-	//such as porxy...
+	ID           int
+	Name         string
+	Description  string
+	Schema       string //no types,maybe "xyz" or "tms"
+	Min          int
+	Max          int
+	Format       string
+	JSON         string
+	URL          string
+	Token        string
+	Subdomains   []string //{s}轮换的子域名列表
+	Balance      string   //子域名分配方式, hash或roundrobin
+	MatrixPrefix string   //WMTS {TileMatrix}前缀, 如"EPSG:900913:"
+	Source                //请求头、cookie、代理等
 }
 
 // CreateTileMap 添加地图
@@ -51,8 +52,12 @@ func GetTileMapList() map[int]TileMap {
 
 // TileURL 获取瓦片URL
 func (m TileMap) getTileURL(t maptile.Tile) string {
-	url := strings.Replace(m.URL, "{x}", strconv.Itoa(int(t.X)), -1)
-	url = strings.Replace(url, "{y}", strconv.Itoa(int(t.Y)), -1)
-	url = strings.Replace(url, "{z}", strconv.Itoa(int(t.Z)), -1)
-	return url
+	tpl := URLTemplate{
+		URL:          m.URL,
+		Subdomains:   m.Subdomains,
+		Balance:      m.Balance,
+		MatrixPrefix: m.MatrixPrefix,
+		TMS:          m.Schema == "tms",
+	}
+	return tpl.Expand(t)
 }
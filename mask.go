@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// maskBuffer 栅格裁剪时瓦片外扩的缓冲区, 瓦片边长的倍数
+const maskBuffer = 0.01
+
+// TileMask 边界瓦片按图层轮廓裁剪, 轮廓外的像素置为透明, 输出jpg时填充Fill颜色
+type TileMask struct {
+	Fill    color.NRGBA
+	Encoder *RasterEncoder //裁剪后的编码器, 未配置转码时按源格式编码
+}
+
+// NewTileMask 从配置创建轮廓裁剪, 未开启或源为矢量瓦片时返回nil
+func NewTileMask(src string, enc *RasterEncoder) *TileMask {
+	if !viper.GetBool("output.clip.enabled") {
+		return nil
+	}
+	if src == PBF {
+		log.Warnf("can not clip %s tiles as raster, skip clipping ~", src)
+		return nil
+	}
+	fill, err := parseColor(viper.GetString("output.clip.fill"))
+	if err != nil {
+		log.Warnf("parse clip fill error ~ %s, use white", err)
+		fill = color.NRGBA{255, 255, 255, 255}
+	}
+	if enc == nil {
+		enc = rasterEncoder(src)
+	}
+	return &TileMask{Fill: fill, Encoder: enc}
+}
+
+// Apply 裁剪瓦片并编码, 瓦片完全在轮廓内时只做转码, 完全在轮廓外时返回空
+// 先按经纬度范围判断瓦片与轮廓的关系, 只有边界瓦片需要解码后逐像素裁剪
+func (m *TileMask) Apply(t maptile.Tile, c orb.Collection, body []byte, encode bool) ([]byte, error) {
+	class := classifyTile(c, t)
+	if class == tileOutside {
+		return nil, nil
+	}
+	if class == tileInside && !encode {
+		return body, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("decode tile error: %s", err)
+	}
+	if class == tileBoundary {
+		masked, ok := m.Mask(img, t, c)
+		if !ok {
+			return nil, nil
+		}
+		if masked != nil {
+			return m.Encoder.EncodeImage(masked)
+		}
+	}
+	return m.Encoder.EncodeImage(img)
+}
+
+// 瓦片与轮廓的关系
+const (
+	tileInside   = iota //完全在轮廓内, 或轮廓中没有面
+	tileOutside         //完全在轮廓外
+	tileBoundary        //与轮廓的边相交
+)
+
+// classifyTile 按经纬度判断瓦片与轮廓的关系, 无需解码及投影
+// 范围外扩maskBuffer, 墨卡托与经纬度下边的微小差异不会漏判边界瓦片
+func classifyTile(c orb.Collection, t maptile.Tile) int {
+	b := t.Bound(maskBuffer)
+	polygons, found := boundPolygons(c, b)
+	if !found {
+		return tileInside
+	}
+	if nearBoundary(b, polygons) {
+		return tileBoundary
+	}
+	if clipPoint(t.Center(), polygons) {
+		return tileInside
+	}
+	return tileOutside
+}
+
+// boundPolygons 轮廓中范围与b相交的面, 轮廓中没有面时返回false
+func boundPolygons(c orb.Collection, b orb.Bound) ([]orb.Polygon, bool) {
+	var polygons []orb.Polygon
+	found := false
+	add := func(p orb.Polygon) {
+		found = true
+		if p.Bound().Intersects(b) {
+			polygons = append(polygons, p)
+		}
+	}
+	for _, g := range c {
+		switch g := g.(type) {
+		case orb.Polygon:
+			add(g)
+		case orb.MultiPolygon:
+			for _, p := range g {
+				add(p)
+			}
+		}
+	}
+	return polygons, found
+}
+
+// Mask 返回裁剪后的图片, 瓦片完全在轮廓内或轮廓中没有面时返回nil, 没有像素在轮廓内时返回false
+func (m *TileMask) Mask(img image.Image, t maptile.Tile, c orb.Collection) (image.Image, bool) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	polygons, ok := tilePolygons(c, t, w, h, maskBuffer)
+	if !ok {
+		return nil, true
+	}
+	inside := make([]bool, w*h)
+	n := 0
+	for _, p := range polygons {
+		n += fillPolygon(inside, w, h, p)
+	}
+	if n == 0 {
+		return nil, false
+	}
+	if n == w*h {
+		return nil, true
+	}
+	outside := color.NRGBA{}
+	if m.Encoder.Format == JPG {
+		outside = m.Fill
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if inside[y*w+x] {
+				out.Set(x, y, img.At(b.Min.X+x, b.Min.Y+y))
+			} else {
+				out.SetNRGBA(x, y, outside)
+			}
+		}
+	}
+	return out, true
+}
+
+// tilePolygons 轮廓中的面投影到w*h的瓦片像素空间, 并裁剪到含buffer倍缓冲区的瓦片范围, 轮廓中没有面时返回false
+// 投影前先按经纬度裁剪到瓦片范围, 只投影瓦片附近的顶点, 面的边在墨卡托下为直线, 与地图上的显示一致
+func tilePolygons(c orb.Collection, t maptile.Tile, w, h int, buffer float64) ([]orb.Polygon, bool) {
+	bound := t.Bound(buffer)
+	near, found := boundPolygons(c, bound)
+	var polygons []orb.Polygon
+	for _, p := range near {
+		var clipped orb.Polygon
+		for i, r := range p {
+			r = clipRing(bound, r)
+			if len(r) < 4 {
+				if i == 0 {
+					break
+				}
+				continue
+			}
+			clipped = append(clipped, r)
+		}
+		if len(clipped) > 0 {
+			polygons = append(polygons, pixelPolygon(clipped, t, w, h))
+		}
+	}
+	return polygons, found
+}
+
+// clipRing 环按经纬度范围逐边裁剪(Sutherland-Hodgman), 未闭合的环视为首尾相连, 返回闭合的环
+// 与范围边的交点取墨卡托下直线上的点, 只有跨越范围边的线段需要投影
+func clipRing(b orb.Bound, r orb.Ring) orb.Ring {
+	in := r
+	for edge := 0; edge < 4; edge++ {
+		if len(in) == 0 {
+			return nil
+		}
+		var out orb.Ring
+		prev := in[len(in)-1]
+		prevInside := insideEdge(b, edge, prev)
+		for _, p := range in {
+			inside := insideEdge(b, edge, p)
+			if inside != prevInside {
+				out = append(out, mercatorCross(b, edge, prev, p))
+			}
+			if inside {
+				out = append(out, p)
+			}
+			prev, prevInside = p, inside
+		}
+		in = out
+	}
+	if len(in) > 0 && in[0] != in[len(in)-1] {
+		in = append(in, in[0])
+	}
+	return in
+}
+
+// insideEdge 点是否在范围第edge条边(左、右、下、上)的内侧
+func insideEdge(b orb.Bound, edge int, p orb.Point) bool {
+	switch edge {
+	case 0:
+		return p[0] >= b.Min[0]
+	case 1:
+		return p[0] <= b.Max[0]
+	case 2:
+		return p[1] >= b.Min[1]
+	}
+	return p[1] <= b.Max[1]
+}
+
+// mercatorCross 线段ab与范围第edge条边的交点, 按墨卡托下的直线计算
+func mercatorCross(b orb.Bound, edge int, a, p orb.Point) orb.Point {
+	fa, fp := maptile.Fraction(a, 0), maptile.Fraction(p, 0)
+	switch edge {
+	case 0, 1:
+		x := b.Min[0]
+		if edge == 1 {
+			x = b.Max[0]
+		}
+		k := (x - a[0]) / (p[0] - a[0])
+		y := fa[1] + k*(fp[1]-fa[1])
+		return orb.Point{x, fractionLonLat(orb.Point{0, y}, 0)[1]}
+	}
+	lat := b.Min[1]
+	if edge == 3 {
+		lat = b.Max[1]
+	}
+	y := maptile.Fraction(orb.Point{0, lat}, 0)[1]
+	k := (y - fa[1]) / (fp[1] - fa[1])
+	return orb.Point{a[0] + k*(p[0]-a[0]), lat}
+}
+
+// pixelPolygon 经纬度面转为瓦片像素坐标
+func pixelPolygon(p orb.Polygon, t maptile.Tile, w, h int) orb.Polygon {
+	out := make(orb.Polygon, len(p))
+	for i, r := range p {
+		ring := make(orb.Ring, len(r))
+		for j, pt := range r {
+			f := maptile.Fraction(pt, t.Z)
+			ring[j] = orb.Point{(f[0] - float64(t.X)) * float64(w), (f[1] - float64(t.Y)) * float64(h)}
+		}
+		out[i] = ring
+	}
+	return out
+}
+
+// fillPolygon 按奇偶规则逐行填充面(含内环), 以像素中心判断, 返回新填充的像素数
+func fillPolygon(inside []bool, w, h int, p orb.Polygon) int {
+	n := 0
+	var xs []float64
+	for y := 0; y < h; y++ {
+		sy := float64(y) + 0.5
+		xs = xs[:0]
+		for _, r := range p {
+			for i := range r {
+				a, b := r[i], r[(i+1)%len(r)]
+				if (a[1] <= sy && b[1] > sy) || (b[1] <= sy && a[1] > sy) {
+					xs = append(xs, a[0]+(sy-a[1])/(b[1]-a[1])*(b[0]-a[0]))
+				}
+			}
+		}
+		sort.Float64s(xs)
+		for i := 0; i+1 < len(xs); i += 2 {
+			x0 := int(math.Max(0, math.Ceil(xs[i]-0.5)))
+			x1 := int(math.Min(float64(w), math.Ceil(xs[i+1]-0.5)))
+			for x := x0; x < x1; x++ {
+				if !inside[y*w+x] {
+					inside[y*w+x] = true
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+// parseColor 解析#rrggbb或#rrggbbaa颜色
+func parseColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(s) != 6 && len(s) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// square 经纬度范围对应的面, 未闭合
+func square(b orb.Bound) orb.Polygon {
+	return orb.Polygon{{b.Min, {b.Max[0], b.Min[1]}, b.Max, {b.Min[0], b.Max[1]}}}
+}
+
+func TestClassifyTile(t *testing.T) {
+	tile := maptile.New(3370, 1654, 12)
+	b := tile.Bound()
+	w := b.Max[0] - b.Min[0]
+	cases := []struct {
+		name string
+		c    orb.Collection
+		want int
+	}{
+		{"no polygons", orb.Collection{b.Center()}, tileInside},
+		{"inside", orb.Collection{square(b.Pad(w))}, tileInside},
+		{"outside", orb.Collection{square(orb.Bound{Min: orb.Point{b.Max[0] + w, b.Min[1]}, Max: orb.Point{b.Max[0] + 2*w, b.Max[1]}})}, tileOutside},
+		{"boundary", orb.Collection{square(orb.Bound{Min: b.Center(), Max: orb.Point{b.Max[0] + w, b.Max[1] + w}})}, tileBoundary},
+		//内环中的瓦片在面外
+		{"hole", orb.Collection{append(square(b.Pad(2*w)), square(b.Pad(w / 2))[0])}, tileOutside},
+	}
+	for _, c := range cases {
+		if got := classifyTile(c.c, tile); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestTileMaskApply(t *testing.T) {
+	m := &TileMask{Encoder: rasterEncoder(PNG)}
+	tile := maptile.New(3370, 1654, 12)
+	b := tile.Bound()
+	w := b.Max[0] - b.Min[0]
+
+	//内部瓦片不解码, 原样返回
+	body := []byte("not an image")
+	data, err := m.Apply(tile, orb.Collection{square(b.Pad(w))}, body, false)
+	if err != nil || !bytes.Equal(data, body) {
+		t.Fatalf("inside tile = %q, %v, want the body unchanged", data, err)
+	}
+
+	//轮廓外扩得到的瓦片完全在面外, 不保存
+	right := orb.Bound{Min: orb.Point{b.Max[0] + w, b.Min[1]}, Max: orb.Point{b.Max[0] + 2*w, b.Max[1]}}
+	data, err = m.Apply(tile, orb.Collection{square(right)}, body, false)
+	if err != nil || data != nil {
+		t.Fatalf("outside tile = %q, %v, want nil", data, err)
+	}
+
+	//左半边在面内
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	left := orb.Bound{Min: orb.Point{b.Min[0] - w, b.Min[1] - w}, Max: orb.Point{b.Center()[0], b.Max[1] + w}}
+	data, err = m.Apply(tile, orb.Collection{square(left)}, buf.Bytes(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := color.NRGBAModel.Convert(out.At(10, 128)).(color.NRGBA).A; a != 255 {
+		t.Errorf("pixel inside alpha = %d, want 255", a)
+	}
+	if a := color.NRGBAModel.Convert(out.At(245, 128)).(color.NRGBA).A; a != 0 {
+		t.Errorf("pixel outside alpha = %d, want 0", a)
+	}
+
+	//面的边距瓦片不足缓冲区, 没有像素在面内
+	near := orb.Bound{Min: orb.Point{b.Max[0] + w*maskBuffer/2, b.Min[1]}, Max: orb.Point{b.Max[0] + w, b.Max[1]}}
+	data, err = m.Apply(tile, orb.Collection{square(near)}, buf.Bytes(), false)
+	if err != nil || data != nil {
+		t.Errorf("tile without inside pixels = %d bytes, %v, want nil", len(data), err)
+	}
+}
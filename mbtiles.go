@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+	log "github.com/sirupsen/logrus"
+)
+
+// MBTileStore MBTiles存储
+type MBTileStore struct {
+	File       string
+	Dedupe     bool //map/images表去重存储
+	Keep       bool //保留已有文件, 续传及skip/update模式
+	Update     bool //update模式, 替换已存在的瓦片并保存校验信息
+	db         *sql.DB
+	insertStmt *sql.Stmt
+	imageStmt  *sql.Stmt //去重模式下写入images表
+	validStmt  *sql.Stmt
+}
+
+// Open 初始化配置MBTile库
+func (s *MBTileStore) Open() error {
+	if !s.Keep {
+		os.Remove(s.File)
+	}
+	db, err := sql.Open("sqlite3", s.File)
+	if err != nil {
+		return err
+	}
+	//sqlite单连接写入, 多个saver的事务依次提交
+	db.SetMaxOpenConns(1)
+
+	err = optimizeConnection(db)
+	if err != nil {
+		return err
+	}
+
+	if s.Dedupe {
+		err = setupDedupeTables(db)
+	} else {
+		_, err = db.Exec("create table if not exists tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("create table if not exists metadata (name text, value text);")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("create unique index if not exists name on metadata (name);")
+	if err != nil {
+		return err
+	}
+
+	if !s.Dedupe {
+		_, err = db.Exec("create unique index if not exists tile_index on tiles(zoom_level, tile_column, tile_row);")
+		if err != nil {
+			return err
+		}
+	}
+
+	//仅update模式保存校验信息, 其他模式不在发布的文件中添加tile_validators表
+	if s.Update {
+		err = setupValidatorTable(db)
+		if err != nil {
+			return err
+		}
+		s.validStmt, err = prepareValidator(db)
+		if err != nil {
+			return err
+		}
+	}
+
+	insert := "insert"
+	if s.Update {
+		insert = "insert or replace"
+	}
+	if s.Dedupe {
+		s.insertStmt, err = db.Prepare(insert + " into map (zoom_level, tile_column, tile_row, tile_id) values (?, ?, ?, ?);")
+		if err != nil {
+			return err
+		}
+		s.imageStmt, err = db.Prepare("insert or ignore into images (tile_id, tile_data) values (?, ?);")
+	} else {
+		s.insertStmt, err = db.Prepare(insert + " into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?);")
+	}
+	if err != nil {
+		return err
+	}
+
+	s.db = db
+	return nil
+}
+
+// Put 写入瓦片
+func (s *MBTileStore) Put(tile Tile) error {
+	return s.PutBatch([]Tile{tile})[tile.T]
+}
+
+// PutBatch 事务批量写入瓦片
+func (s *MBTileStore) PutBatch(tiles []Tile) map[maptile.Tile]error {
+	return putSQLiteBatch(s.db, tiles, func(tx *sql.Tx) func(Tile) error {
+		stmt := tx.Stmt(s.insertStmt)
+		var validStmt *sql.Stmt
+		if s.validStmt != nil {
+			validStmt = tx.Stmt(s.validStmt)
+		}
+		var imageStmt *sql.Stmt
+		if s.Dedupe {
+			imageStmt = tx.Stmt(s.imageStmt)
+		}
+		return func(tile Tile) error {
+			var err error
+			if imageStmt != nil {
+				err = saveToDedupeMBTile(tile, stmt, imageStmt)
+			} else {
+				err = saveToMBTile(tile, stmt)
+			}
+			if err != nil {
+				return err
+			}
+			if validStmt == nil {
+				return nil
+			}
+			return saveValidator(validStmt, tile.T.Z, tile.T.X, tile.flipY(), tile.V)
+		}
+	})
+}
+
+// Has 瓦片是否已存在
+func (s *MBTileStore) Has(t maptile.Tile) (bool, error) {
+	var n int
+	err := s.db.QueryRow("select count(*) from tiles where zoom_level = ? and tile_column = ? and tile_row = ?;", t.Z, t.X, Tile{T: t}.flipY()).Scan(&n)
+	return n > 0, err
+}
+
+// Get 读取瓦片
+func (s *MBTileStore) Get(t maptile.Tile) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow("select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?;", t.Z, t.X, Tile{T: t}.flipY()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrTileNotFound
+	}
+	return data, err
+}
+
+// Validator 读取瓦片校验信息, 非update模式时返回空
+func (s *MBTileStore) Validator(t maptile.Tile) (Validator, error) {
+	if s.validStmt == nil {
+		return Validator{}, nil
+	}
+	return queryValidator(s.db, t.Z, t.X, Tile{T: t}.flipY())
+}
+
+// WriteMetadata 写入metadata表, 保留已有文件时合并范围及级别
+func (s *MBTileStore) WriteMetadata(meta map[string]string) error {
+	if s.Keep {
+		old := make(map[string]string)
+		rows, err := s.db.Query("select name, value from metadata;")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var name, value string
+			if rows.Scan(&name, &value) == nil {
+				old[name] = value
+			}
+		}
+		rows.Close()
+		meta = mergeMeta(old, meta)
+	}
+	for name, value := range meta {
+		_, err := s.db.Exec("insert or replace into metadata (name, value) values (?, ?)", name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 关闭预编译语句及数据库
+func (s *MBTileStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	s.insertStmt.Close()
+	if s.validStmt != nil {
+		s.validStmt.Close()
+	}
+	if s.imageStmt != nil {
+		s.imageStmt.Close()
+	}
+	return s.db.Close()
+}
+
+// putSQLiteBatch 在一个事务中写入瓦片, 提交失败时全部瓦片视为失败
+func putSQLiteBatch(db *sql.DB, tiles []Tile, prepare func(*sql.Tx) func(Tile) error) map[maptile.Tile]error {
+	errs := make(map[maptile.Tile]error)
+	tx, err := db.Begin()
+	if err != nil {
+		for _, tile := range tiles {
+			errs[tile.T] = err
+		}
+		return errs
+	}
+	put := prepare(tx)
+	saved := 0
+	for _, tile := range tiles {
+		err := put(tile)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "UNIQUE constraint failed") {
+				//续传时瓦片已入库但账本未更新
+				log.Warnf("save %v tile error ~ %s", tile.T, err)
+				saved++
+			} else {
+				errs[tile.T] = err
+			}
+			continue
+		}
+		saved++
+	}
+	err = tx.Commit()
+	if err != nil {
+		err = fmt.Errorf("commit %d tiles error: %s", saved, err)
+		for _, tile := range tiles {
+			errs[tile.T] = err
+		}
+	}
+	return errs
+}
+
+func saveToMBTile(tile Tile, stmt *sql.Stmt) error {
+	_, err := stmt.Exec(tile.T.Z, tile.T.X, tile.flipY(), tile.C)
+	// _, err := db.Exec("insert or ignore into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?);", tile.T.Z, tile.T.X, tile.flipY(), tile.C)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// saveToDedupeMBTile 去重模式保存, 相同内容的瓦片只存储一次
+func saveToDedupeMBTile(tile Tile, mapStmt, imageStmt *sql.Stmt) error {
+	id := fmt.Sprintf("%x", md5.Sum(tile.C))
+	_, err := imageStmt.Exec(id, tile.C)
+	if err != nil {
+		return err
+	}
+	_, err = mapStmt.Exec(tile.T.Z, tile.T.X, tile.flipY(), id)
+	return err
+}
+
+// setupDedupeTables 创建map、images表及tiles视图
+func setupDedupeTables(db *sql.DB) error {
+	_, err := db.Exec("create table if not exists map (zoom_level integer, tile_column integer, tile_row integer, tile_id text);")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("create table if not exists images (tile_data blob, tile_id text);")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("create unique index if not exists map_index on map (zoom_level, tile_column, tile_row);")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("create unique index if not exists images_id on images (tile_id);")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`create view if not exists tiles as select map.zoom_level as zoom_level, map.tile_column as tile_column, map.tile_row as tile_row, images.tile_data as tile_data from map join images on images.tile_id = map.tile_id;`)
+	return err
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	log "github.com/sirupsen/logrus"
+)
+
+// PMTiles v3 常量
+const (
+	PMTilesHeaderSize = 127
+	PMTilesRootSize   = 16384 //头与根目录须在前16KB内
+
+	pmCompressionNone = 1
+	pmCompressionGzip = 2
+
+	pmTileTypeUnknown = 0
+	pmTileTypeMVT     = 1
+	pmTileTypePNG     = 2
+	pmTileTypeJPEG    = 3
+	pmTileTypeWEBP    = 4
+)
+
+// pmEntry 目录项, Offset相对瓦片数据区起始
+type pmEntry struct {
+	TileID    uint64
+	Offset    uint64
+	Length    uint32
+	RunLength uint32
+}
+
+// pmRecord 临时文件中的瓦片记录
+type pmRecord struct {
+	TileID uint64
+	Offset int64 //数据在临时文件中的位置
+	Length uint32
+	Hash   [md5.Size]byte
+}
+
+// PMTilesMeta 归档头信息及元数据
+type PMTilesMeta struct {
+	Format   string
+	Min      int
+	Max      int
+	Bound    orb.Bound
+	Center   orb.Point
+	Metadata map[string]interface{}
+}
+
+// PMTilesStore PMTiles v3 单文件归档存储
+// 下载过程中瓦片追加写入临时文件, 关闭时按TileID排序聚簇、去重并写出目录
+type PMTilesStore struct {
+	sync.Mutex
+	File     string
+	Keep     bool //续传时读取已有临时文件, 无临时文件时导入已有归档
+	KeepTemp bool //关闭后保留临时文件以便续传
+	tmp      *os.File
+	size     int64
+	records  []pmRecord
+	index    map[uint64]int //TileID对应最后写入的记录
+	meta     PMTilesMeta
+	old      map[string]string //已有归档的元数据
+}
+
+// Open 创建临时文件, 续传时读取已有记录
+func (s *PMTilesStore) Open() error {
+	tmpFile := s.File + ".tmp"
+	if !s.Keep {
+		os.Remove(tmpFile)
+	}
+	tmp, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	s.tmp = tmp
+	s.index = make(map[uint64]int)
+	if s.Keep {
+		err = s.scan()
+		if err == nil {
+			err = s.importArchive()
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// scan 读取临时文件记录, 截断末尾不完整的记录
+func (s *PMTilesStore) scan() error {
+	var head [12]byte
+	for {
+		_, err := s.tmp.ReadAt(head[:], s.size)
+		if err != nil {
+			break
+		}
+		r := pmRecord{
+			TileID: binary.LittleEndian.Uint64(head[:8]),
+			Offset: s.size + 12,
+			Length: binary.LittleEndian.Uint32(head[8:]),
+		}
+		data := make([]byte, r.Length)
+		_, err = s.tmp.ReadAt(data, r.Offset)
+		if err != nil {
+			break
+		}
+		r.Hash = md5.Sum(data)
+		s.index[r.TileID] = len(s.records)
+		s.records = append(s.records, r)
+		s.size = r.Offset + int64(r.Length)
+	}
+	if len(s.records) > 0 {
+		log.Infof("resume pmtiles %s, %d tiles in temp file ~", s.File, len(s.records))
+	}
+	return s.tmp.Truncate(s.size)
+}
+
+// importArchive 读取已有归档的元数据, 临时文件为空时导入其中的瓦片, 以便在已有归档上增量下载
+func (s *PMTilesStore) importArchive() error {
+	f, err := os.Open(s.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, PMTilesHeaderSize)
+	_, err = f.ReadAt(header, 0)
+	if err != nil || string(header[:7]) != "PMTiles" || header[7] != 3 {
+		return fmt.Errorf("%s is not a PMTiles v3 archive", s.File)
+	}
+	le := binary.LittleEndian
+	section := func(offset, length uint64) ([]byte, error) {
+		b := make([]byte, length)
+		_, err := f.ReadAt(b, int64(offset))
+		if err != nil {
+			return nil, err
+		}
+		if header[97] == pmCompressionGzip {
+			return gunzipBytes(b)
+		}
+		return b, nil
+	}
+
+	metadata, err := section(le.Uint64(header[24:]), le.Uint64(header[32:]))
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	json.Unmarshal(metadata, &values)
+	s.old = make(map[string]string)
+	for k, v := range values {
+		if str, ok := v.(string); ok {
+			s.old[k] = str
+		}
+	}
+	if len(s.records) > 0 {
+		return nil
+	}
+
+	leafOffset, dataOffset := le.Uint64(header[40:]), le.Uint64(header[56:])
+	var walk func(dir []byte) error
+	walk = func(dir []byte) error {
+		entries, err := deserializeDirectory(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.RunLength == 0 {
+				leaf, err := section(leafOffset+e.Offset, uint64(e.Length))
+				if err == nil {
+					err = walk(leaf)
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			data := make([]byte, e.Length)
+			_, err := f.ReadAt(data, int64(dataOffset+e.Offset))
+			if err != nil {
+				return err
+			}
+			for id := e.TileID; id < e.TileID+uint64(e.RunLength); id++ {
+				err = s.append(id, data)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	root, err := section(le.Uint64(header[8:]), le.Uint64(header[16:]))
+	if err == nil {
+		err = walk(root)
+	}
+	if err != nil {
+		return fmt.Errorf("read %s error: %s", s.File, err)
+	}
+	log.Infof("import pmtiles %s, %d tiles ~", s.File, len(s.records))
+	return nil
+}
+
+// Put 写入瓦片
+func (s *PMTilesStore) Put(tile Tile) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.append(zxyToID(uint8(tile.T.Z), tile.T.X, tile.T.Y), tile.C)
+}
+
+// append 追加记录到临时文件, 调用方需持有锁
+func (s *PMTilesStore) append(id uint64, data []byte) error {
+	var head [12]byte
+	binary.LittleEndian.PutUint64(head[:8], id)
+	binary.LittleEndian.PutUint32(head[8:], uint32(len(data)))
+	_, err := s.tmp.WriteAt(append(head[:], data...), s.size)
+	if err != nil {
+		return err
+	}
+	s.index[id] = len(s.records)
+	s.records = append(s.records, pmRecord{
+		TileID: id,
+		Offset: s.size + 12,
+		Length: uint32(len(data)),
+		Hash:   md5.Sum(data),
+	})
+	s.size += int64(len(head) + len(data))
+	return nil
+}
+
+// Has 瓦片是否已写入
+func (s *PMTilesStore) Has(t maptile.Tile) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.index[zxyToID(uint8(t.Z), t.X, t.Y)]
+	return ok, nil
+}
+
+// Get 从临时文件读取瓦片
+func (s *PMTilesStore) Get(t maptile.Tile) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	i, ok := s.index[zxyToID(uint8(t.Z), t.X, t.Y)]
+	if !ok {
+		return nil, ErrTileNotFound
+	}
+	data := make([]byte, s.records[i].Length)
+	_, err := s.tmp.ReadAt(data, s.records[i].Offset)
+	return data, err
+}
+
+// WriteMetadata 保存头信息及元数据, 关闭时写入归档, json项为对象时合并到元数据
+func (s *PMTilesStore) WriteMetadata(meta map[string]string) error {
+	if len(s.old) > 0 {
+		meta = mergeMeta(s.old, meta)
+	}
+	metadata := make(map[string]interface{})
+	for name, value := range meta {
+		metadata[name] = value
+	}
+	var extra map[string]interface{}
+	if json.Unmarshal([]byte(meta["json"]), &extra) == nil {
+		delete(metadata, "json")
+		for name, value := range extra {
+			metadata[name] = value
+		}
+	}
+	min, max := metaZoom(meta)
+	s.Lock()
+	s.meta = PMTilesMeta{
+		Format:   meta["format"],
+		Min:      min,
+		Max:      max,
+		Bound:    metaBound(meta),
+		Center:   metaCenter(meta),
+		Metadata: metadata,
+	}
+	s.Unlock()
+	return nil
+}
+
+// Close 写出归档文件
+func (s *PMTilesStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.tmp == nil {
+		return nil
+	}
+	meta := s.meta
+	// 按TileID排序, 同一瓦片保留最后写入的数据
+	sort.SliceStable(s.records, func(i, j int) bool {
+		return s.records[i].TileID < s.records[j].TileID
+	})
+	records := s.records[:0:0]
+	for i, r := range s.records {
+		if i+1 < len(s.records) && s.records[i+1].TileID == r.TileID {
+			continue
+		}
+		records = append(records, r)
+	}
+
+	// 计算聚簇后的数据位置, 相同内容只存一份, 连续相同内容合并为run
+	var entries []pmEntry
+	var sources []pmRecord //需写出的数据, 按输出顺序
+	offsets := make(map[[md5.Size]byte]uint64)
+	var dataSize, addressed uint64
+	for _, r := range records {
+		addressed++
+		offset, ok := offsets[r.Hash]
+		if !ok {
+			offset = dataSize
+			offsets[r.Hash] = offset
+			sources = append(sources, r)
+			dataSize += uint64(r.Length)
+		}
+		if n := len(entries); n > 0 {
+			last := &entries[n-1]
+			if last.Offset == offset && last.TileID+uint64(last.RunLength) == r.TileID {
+				last.RunLength++
+				continue
+			}
+		}
+		entries = append(entries, pmEntry{TileID: r.TileID, Offset: offset, Length: r.Length, RunLength: 1})
+	}
+
+	root, leaves, err := buildDirectories(entries)
+	if err != nil {
+		return err
+	}
+	metadata, err := json.Marshal(meta.Metadata)
+	if err != nil {
+		return err
+	}
+	metadata, err = gzipBytes(metadata)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(s.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rootOffset := uint64(PMTilesHeaderSize)
+	metaOffset := rootOffset + uint64(len(root))
+	leafOffset := metaOffset + uint64(len(metadata))
+	dataOffset := leafOffset + uint64(len(leaves))
+
+	header := make([]byte, PMTilesHeaderSize)
+	copy(header[0:7], "PMTiles")
+	header[7] = 3
+	le := binary.LittleEndian
+	le.PutUint64(header[8:], rootOffset)
+	le.PutUint64(header[16:], uint64(len(root)))
+	le.PutUint64(header[24:], metaOffset)
+	le.PutUint64(header[32:], uint64(len(metadata)))
+	le.PutUint64(header[40:], leafOffset)
+	le.PutUint64(header[48:], uint64(len(leaves)))
+	le.PutUint64(header[56:], dataOffset)
+	le.PutUint64(header[64:], dataSize)
+	le.PutUint64(header[72:], addressed)
+	le.PutUint64(header[80:], uint64(len(entries)))
+	le.PutUint64(header[88:], uint64(len(sources)))
+	header[96] = 1 //clustered
+	header[97] = pmCompressionGzip
+	header[98], header[99] = pmTileFormat(meta.Format)
+	header[100] = uint8(meta.Min)
+	header[101] = uint8(meta.Max)
+	le.PutUint32(header[102:], uint32(e7(meta.Bound.Left())))
+	le.PutUint32(header[106:], uint32(e7(meta.Bound.Bottom())))
+	le.PutUint32(header[110:], uint32(e7(meta.Bound.Right())))
+	le.PutUint32(header[114:], uint32(e7(meta.Bound.Top())))
+	header[118] = uint8((meta.Min + meta.Max) / 2)
+	le.PutUint32(header[119:], uint32(e7(meta.Center.X())))
+	le.PutUint32(header[123:], uint32(e7(meta.Center.Y())))
+
+	for _, b := range [][]byte{header, root, metadata, leaves} {
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+	}
+	for _, r := range sources {
+		_, err := io.Copy(f, io.NewSectionReader(s.tmp, r.Offset, int64(r.Length)))
+		if err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	tmpFile := s.tmp.Name()
+	err = s.tmp.Close()
+	s.tmp = nil
+	if !s.KeepTemp {
+		os.Remove(tmpFile)
+	}
+	return err
+}
+
+// buildDirectories 生成根目录及叶目录, 根目录过大时按叶目录拆分
+func buildDirectories(entries []pmEntry) (root, leaves []byte, err error) {
+	root, err = serializeDirectory(entries)
+	if err != nil || len(root) <= PMTilesRootSize-PMTilesHeaderSize {
+		return root, nil, err
+	}
+	leafSize := len(entries) / 3500
+	if leafSize < 4096 {
+		leafSize = 4096
+	}
+	for {
+		var rootEntries []pmEntry
+		var buf bytes.Buffer
+		for i := 0; i < len(entries); i += leafSize {
+			end := i + leafSize
+			if end > len(entries) {
+				end = len(entries)
+			}
+			leaf, err := serializeDirectory(entries[i:end])
+			if err != nil {
+				return nil, nil, err
+			}
+			rootEntries = append(rootEntries, pmEntry{
+				TileID: entries[i].TileID,
+				Offset: uint64(buf.Len()),
+				Length: uint32(len(leaf)),
+			})
+			buf.Write(leaf)
+		}
+		root, err = serializeDirectory(rootEntries)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(root) <= PMTilesRootSize-PMTilesHeaderSize {
+			return root, buf.Bytes(), nil
+		}
+		leafSize = leafSize * 12 / 10
+	}
+}
+
+// serializeDirectory 目录序列化, 各列varint编码后gzip压缩
+func serializeDirectory(entries []pmEntry) ([]byte, error) {
+	var b bytes.Buffer
+	tmp := make([]byte, binary.MaxVarintLen64)
+	put := func(v uint64) {
+		n := binary.PutUvarint(tmp, v)
+		b.Write(tmp[:n])
+	}
+	put(uint64(len(entries)))
+	var last uint64
+	for _, e := range entries {
+		put(e.TileID - last)
+		last = e.TileID
+	}
+	for _, e := range entries {
+		put(uint64(e.RunLength))
+	}
+	for _, e := range entries {
+		put(uint64(e.Length))
+	}
+	for i, e := range entries {
+		if i > 0 && e.Offset == entries[i-1].Offset+uint64(entries[i-1].Length) {
+			put(0)
+		} else {
+			put(e.Offset + 1)
+		}
+	}
+	return gzipBytes(b.Bytes())
+}
+
+// deserializeDirectory 解析目录
+func deserializeDirectory(data []byte) ([]pmEntry, error) {
+	r := bytes.NewReader(data)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(data)) {
+		return nil, fmt.Errorf("invalid directory")
+	}
+	entries := make([]pmEntry, n)
+	var last uint64
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		last += v
+		entries[i].TileID = last
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].RunLength = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Length = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if v == 0 && i > 0 {
+			entries[i].Offset = entries[i-1].Offset + uint64(entries[i-1].Length)
+		} else {
+			entries[i].Offset = v - 1
+		}
+	}
+	return entries, nil
+}
+
+// zxyToID 瓦片行列号转为Hilbert曲线TileID
+func zxyToID(z uint8, x, y uint32) uint64 {
+	var acc uint64
+	for t := uint8(0); t < z; t++ {
+		acc += uint64(1) << (2 * t)
+	}
+	n := uint64(1) << z
+	tx, ty := uint64(x), uint64(y)
+	var d uint64
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint64
+		if tx&s > 0 {
+			rx = 1
+		}
+		if ty&s > 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		if ry == 0 {
+			if rx == 1 {
+				tx = s - 1 - tx
+				ty = s - 1 - ty
+			}
+			tx, ty = ty, tx
+		}
+	}
+	return acc + d
+}
+
+// pmTileFormat 瓦片压缩方式及类型, pbf瓦片已gzip压缩
+func pmTileFormat(format string) (compression, tileType uint8) {
+	switch format {
+	case PBF:
+		return pmCompressionGzip, pmTileTypeMVT
+	case PNG:
+		return pmCompressionNone, pmTileTypePNG
+	case JPG, "jpeg":
+		return pmCompressionNone, pmTileTypeJPEG
+	case WEBP:
+		return pmCompressionNone, pmTileTypeWEBP
+	}
+	return pmCompressionNone, pmTileTypeUnknown
+}
+
+func e7(v float64) int32 {
+	return int32(math.Round(v * 1e7))
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
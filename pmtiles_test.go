@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestZxyToID(t *testing.T) {
+	//PMTiles v3 规范及参考实现中的TileID
+	cases := []struct {
+		z    uint8
+		x, y uint32
+		id   uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1},
+		{1, 0, 1, 2},
+		{1, 1, 1, 3},
+		{1, 1, 0, 4},
+		{2, 0, 0, 5},
+		{12, 3423, 1763, 19078479},
+	}
+	for _, c := range cases {
+		if id := zxyToID(c.z, c.x, c.y); id != c.id {
+			t.Errorf("zxyToID(%d, %d, %d) = %d, want %d", c.z, c.x, c.y, id, c.id)
+		}
+	}
+
+	//每级TileID连续且沿Hilbert曲线相邻的瓦片共边
+	var start uint64
+	for z := uint8(0); z <= 6; z++ {
+		n := uint32(1) << z
+		tiles := make(map[uint64][2]uint32)
+		for x := uint32(0); x < n; x++ {
+			for y := uint32(0); y < n; y++ {
+				tiles[zxyToID(z, x, y)] = [2]uint32{x, y}
+			}
+		}
+		for id := start; id < start+uint64(n)*uint64(n); id++ {
+			cur, ok := tiles[id]
+			if !ok {
+				t.Fatalf("z%d: id %d not used", z, id)
+			}
+			if prev, ok := tiles[id-1]; ok && id > start {
+				dx, dy := int(cur[0])-int(prev[0]), int(cur[1])-int(prev[1])
+				if dx*dx+dy*dy != 1 {
+					t.Fatalf("z%d: id %d %v is not adjacent to %v", z, id, cur, prev)
+				}
+			}
+		}
+		start += uint64(n) * uint64(n)
+	}
+}
+
+// pmReader 按规范读取PMTiles归档, 用于校验写出的文件
+type pmReader struct {
+	data   []byte
+	header []byte
+	dirs   map[uint64][]pmEntry //已解析的叶目录, 按偏移缓存
+	root   []pmEntry
+}
+
+func readPMTiles(t *testing.T, file string) *pmReader {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < PMTilesHeaderSize || string(data[:7]) != "PMTiles" || data[7] != 3 {
+		t.Fatalf("%s is not a PMTiles v3 archive", file)
+	}
+	r := &pmReader{data: data, header: data[:PMTilesHeaderSize], dirs: make(map[uint64][]pmEntry)}
+	r.root = r.directory(t, r.u64(8), r.u64(16))
+	return r
+}
+
+func (r *pmReader) u64(at int) uint64 {
+	return binary.LittleEndian.Uint64(r.header[at:])
+}
+
+func (r *pmReader) e7(at int) int32 {
+	return int32(binary.LittleEndian.Uint32(r.header[at:]))
+}
+
+func (r *pmReader) section(t *testing.T, offset, length uint64) []byte {
+	t.Helper()
+	if offset+length > uint64(len(r.data)) {
+		t.Fatalf("section %d+%d beyond file size %d", offset, length, len(r.data))
+	}
+	return r.data[offset : offset+length]
+}
+
+func (r *pmReader) directory(t *testing.T, offset, length uint64) []pmEntry {
+	t.Helper()
+	raw, err := gunzipBytes(r.section(t, offset, length))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := deserializeDirectory(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// tile 从根目录逐级查找瓦片
+func (r *pmReader) tile(t *testing.T, z uint8, x, y uint32) ([]byte, bool) {
+	t.Helper()
+	id := zxyToID(z, x, y)
+	entries := r.root
+	for depth := 0; depth < 4; depth++ {
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].TileID > id }) - 1
+		if i < 0 {
+			return nil, false
+		}
+		e := entries[i]
+		if e.RunLength > 0 {
+			if id >= e.TileID+uint64(e.RunLength) {
+				return nil, false
+			}
+			return r.section(t, r.u64(56)+e.Offset, uint64(e.Length)), true
+		}
+		leaf, ok := r.dirs[e.Offset]
+		if !ok {
+			leaf = r.directory(t, r.u64(40)+e.Offset, uint64(e.Length))
+			r.dirs[e.Offset] = leaf
+		}
+		entries = leaf
+	}
+	t.Fatalf("tile %d/%d/%d: directory too deep", z, x, y)
+	return nil, false
+}
+
+func TestPMTilesWriteRead(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "t.pmtiles")
+	s := &PMTilesStore{File: file}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	a, b, c, d := []byte("aaaa"), []byte("bb"), []byte("c"), []byte("ddd")
+	puts := []Tile{
+		{T: maptile.New(0, 0, 0), C: a},
+		{T: maptile.New(0, 0, 1), C: b},
+		{T: maptile.New(0, 1, 1), C: b},
+		{T: maptile.New(1, 1, 1), C: b},
+		{T: maptile.New(1, 0, 1), C: a},
+		{T: maptile.New(0, 0, 2), C: c},
+		{T: maptile.New(0, 0, 2), C: d}, //重复写入保留最后的数据
+	}
+	for _, tile := range puts {
+		if err := s.Put(tile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, err := s.Get(maptile.New(0, 0, 2)); err != nil || !bytes.Equal(data, d) {
+		t.Errorf("get before close = %q, %v, want %q", data, err, d)
+	}
+	err := s.WriteMetadata(map[string]string{
+		"name":    "t",
+		"format":  "png",
+		"minzoom": "0",
+		"maxzoom": "2",
+		"bounds":  "118.5,31.25,119.25,32.5",
+		"center":  "118.75,32,1",
+		"json":    `{"vector_layers":[]}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file not removed: %v", err)
+	}
+
+	r := readPMTiles(t, file)
+	//头中各区依次排列: 根目录、元数据、叶目录、瓦片数据
+	rootOffset, rootLen := r.u64(8), r.u64(16)
+	metaOffset, metaLen := r.u64(24), r.u64(32)
+	leafOffset, leafLen := r.u64(40), r.u64(48)
+	dataOffset, dataLen := r.u64(56), r.u64(64)
+	if rootOffset != PMTilesHeaderSize || metaOffset != rootOffset+rootLen ||
+		leafOffset != metaOffset+metaLen || leafLen != 0 || dataOffset != leafOffset+leafLen ||
+		dataOffset+dataLen != uint64(len(r.data)) {
+		t.Errorf("sections root %d+%d meta %d+%d leaf %d+%d data %d+%d, file %d",
+			rootOffset, rootLen, metaOffset, metaLen, leafOffset, leafLen, dataOffset, dataLen, len(r.data))
+	}
+	//6个瓦片, 4个目录项, 3份数据
+	if dataLen != 9 || r.u64(72) != 6 || r.u64(80) != 4 || r.u64(88) != 3 {
+		t.Errorf("data %d, addressed %d, entries %d, contents %d, want 9, 6, 4, 3", dataLen, r.u64(72), r.u64(80), r.u64(88))
+	}
+	h := r.header
+	if h[96] != 1 || h[97] != pmCompressionGzip || h[98] != pmCompressionNone || h[99] != pmTileTypePNG {
+		t.Errorf("clustered %d, internal %d, tile compression %d, type %d", h[96], h[97], h[98], h[99])
+	}
+	if h[100] != 0 || h[101] != 2 || h[118] != 1 {
+		t.Errorf("zoom %d-%d center %d, want 0-2 center 1", h[100], h[101], h[118])
+	}
+	bounds := [6]int32{r.e7(102), r.e7(106), r.e7(110), r.e7(114), r.e7(119), r.e7(123)}
+	if bounds != [6]int32{1185000000, 312500000, 1192500000, 325000000, 1187500000, 320000000} {
+		t.Errorf("bounds and center e7 = %v", bounds)
+	}
+
+	raw, err := gunzipBytes(r.section(t, metaOffset, metaLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta map[string]interface{}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := meta["json"]; ok || meta["name"] != "t" || meta["vector_layers"] == nil {
+		t.Errorf("metadata = %s, want json merged into top level", raw)
+	}
+
+	//1/0/0、1/0/1、1/1/1内容相同且TileID连续, 合并为一项; 1/1/0与0/0/0共用数据
+	want := []pmEntry{
+		{TileID: 0, Offset: 0, Length: 4, RunLength: 1},
+		{TileID: 1, Offset: 4, Length: 2, RunLength: 3},
+		{TileID: 4, Offset: 0, Length: 4, RunLength: 1},
+		{TileID: 5, Offset: 6, Length: 3, RunLength: 1},
+	}
+	if len(r.root) != len(want) {
+		t.Fatalf("root entries = %+v, want %+v", r.root, want)
+	}
+	for i := range want {
+		if r.root[i] != want[i] {
+			t.Errorf("root entry %d = %+v, want %+v", i, r.root[i], want[i])
+		}
+	}
+	//目录按列varint编码, 与上一项数据相接时偏移写0
+	dir, _ := gunzipBytes(r.section(t, rootOffset, rootLen))
+	if wantDir := []byte{4, 0, 1, 3, 1, 1, 3, 1, 1, 4, 2, 4, 3, 1, 0, 1, 7}; !bytes.Equal(dir, wantDir) {
+		t.Errorf("root directory = %v, want %v", dir, wantDir)
+	}
+
+	for _, tile := range puts[:len(puts)-2] {
+		if data, ok := r.tile(t, uint8(tile.T.Z), tile.T.X, tile.T.Y); !ok || !bytes.Equal(data, tile.C) {
+			t.Errorf("tile %v = %q, %v, want %q", tile.T, data, ok, tile.C)
+		}
+	}
+	if data, ok := r.tile(t, 2, 0, 0); !ok || !bytes.Equal(data, d) {
+		t.Errorf("overwritten tile = %q, %v, want %q", data, ok, d)
+	}
+	if _, ok := r.tile(t, 2, 1, 0); ok {
+		t.Error("missing tile 2/1/0 found")
+	}
+}
+
+func TestPMTilesLeafDirectories(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "t.pmtiles")
+	s := &PMTilesStore{File: file}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	//随机选取瓦片及内容, 目录难以压缩, 根目录超过16KB时拆分为叶目录
+	rnd := rand.New(rand.NewSource(1))
+	pool := make([][]byte, 1000)
+	for i := range pool {
+		pool[i] = make([]byte, 1+rnd.Intn(40))
+		rnd.Read(pool[i])
+	}
+	const z = 9
+	want := make(map[maptile.Tile][]byte)
+	for x := uint32(0); x < 1<<z; x++ {
+		for y := uint32(0); y < 1<<z; y++ {
+			if rnd.Intn(2) == 0 {
+				continue
+			}
+			tile := Tile{T: maptile.New(x, y, z), C: pool[rnd.Intn(len(pool))]}
+			want[tile.T] = tile.C
+			if err := s.Put(tile); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.WriteMetadata(map[string]string{"format": "png", "minzoom": "9", "maxzoom": "9"})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := readPMTiles(t, file)
+	if r.u64(16) > PMTilesRootSize-PMTilesHeaderSize || r.u64(48) == 0 {
+		t.Fatalf("root %d bytes, leaves %d bytes, want root within 16KB and leaves", r.u64(16), r.u64(48))
+	}
+	for _, e := range r.root {
+		if e.RunLength != 0 {
+			t.Fatalf("root entry %+v is not a leaf", e)
+		}
+	}
+	if r.u64(72) != uint64(len(want)) {
+		t.Errorf("addressed tiles = %d, want %d", r.u64(72), len(want))
+	}
+	for tile, c := range want {
+		if data, ok := r.tile(t, z, tile.X, tile.Y); !ok || !bytes.Equal(data, c) {
+			t.Fatalf("tile %v = %v, %v, want %v", tile, data, ok, c)
+		}
+	}
+	if len(r.dirs) < 2 {
+		t.Errorf("%d leaf directories read, want several", len(r.dirs))
+	}
+
+	//无临时文件续传时经叶目录导入已有归档
+	s = &PMTilesStore{File: file, Keep: true}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.tmp.Close()
+	if len(s.records) != len(want) {
+		t.Errorf("imported %d tiles, want %d", len(s.records), len(want))
+	}
+	for tile, c := range want {
+		if data, err := s.Get(tile); err != nil || !bytes.Equal(data, c) {
+			t.Fatalf("imported tile %v = %v, %v, want %v", tile, data, err, c)
+		}
+	}
+}
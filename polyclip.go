@@ -0,0 +1,410 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/paulmach/orb"
+)
+
+// 面与任意(凹、带内环)裁剪面求交:
+// 两个面的边在交点处互相打断, 共线重叠的边在对方端点处打断, 保留位于对方内部的边,
+// 各环方向统一为内部位于左侧(外环面积为正、内环为负), 重合的边同向时保留一次、反向时丢弃,
+// 保留的边首尾相连即为交集的环, 再按面积正负组合为面. 内外判断按奇偶规则.
+
+type clipEdge struct {
+	a, b orb.Point
+}
+
+// nearBoundary 范围是否与裁剪面的边相交, 不相交时几何整体在面内或面外
+func nearBoundary(b orb.Bound, clips []orb.Polygon) bool {
+	for _, c := range clips {
+		for _, r := range c {
+			for _, e := range ringEdges(r) {
+				if math.Max(e.a[0], e.b[0]) >= b.Min[0] && math.Min(e.a[0], e.b[0]) <= b.Max[0] &&
+					math.Max(e.a[1], e.b[1]) >= b.Min[1] && math.Min(e.a[1], e.b[1]) <= b.Max[1] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// clipPoint 点是否在任一裁剪面内
+func clipPoint(p orb.Point, clips []orb.Polygon) bool {
+	for _, c := range clips {
+		if polygonContains(c, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// clipLineString 线裁剪到裁剪面内, 返回面内的各段
+func clipLineString(ls orb.LineString, clips []orb.Polygon) orb.MultiLineString {
+	var out orb.MultiLineString
+	for _, c := range clips {
+		var edges []clipEdge
+		for _, r := range c {
+			edges = append(edges, ringEdges(r)...)
+		}
+		var cur orb.LineString
+		for i := 0; i+1 < len(ls); i++ {
+			for _, e := range splitEdge(clipEdge{ls[i], ls[i+1]}, edges) {
+				//位于轮廓边上的部分视为在面内
+				if !onEdges(e, edges) && !polygonContains(c, midPoint(e)) {
+					if len(cur) > 1 {
+						out = append(out, cur)
+					}
+					cur = nil
+					continue
+				}
+				if len(cur) == 0 {
+					cur = orb.LineString{e.a}
+				}
+				cur = append(cur, e.b)
+			}
+		}
+		if len(cur) > 1 {
+			out = append(out, cur)
+		}
+	}
+	return out
+}
+
+// clipPolygon 面裁剪到裁剪面内
+func clipPolygon(p orb.Polygon, clips []orb.Polygon) []orb.Polygon {
+	var out []orb.Polygon
+	for _, c := range clips {
+		out = append(out, intersectPolygon(p, c)...)
+	}
+	return out
+}
+
+// intersectPolygon 两个面求交
+func intersectPolygon(subject, clip orb.Polygon) []orb.Polygon {
+	a, b := orientPolygon(subject), orientPolygon(clip)
+	var ea, eb []clipEdge
+	for _, r := range a {
+		ea = append(ea, ringEdges(r)...)
+	}
+	for _, r := range b {
+		eb = append(eb, ringEdges(r)...)
+	}
+	ca, cb := edgeCuts(ea, eb)
+	var sa, sb []clipEdge
+	for i, e := range ea {
+		sa = append(sa, splitAt(e, ca[i])...)
+	}
+	for i, e := range eb {
+		sb = append(sb, splitAt(e, cb[i])...)
+	}
+	//重合的边在两侧打断后端点相同: 同向时两面内部在同侧, 保留一次; 反向时两面只在边上相接, 丢弃
+	inA := make(map[clipEdge]bool, len(sa))
+	for _, s := range sa {
+		inA[s] = true
+	}
+	inB := make(map[clipEdge]bool, len(sb))
+	for _, s := range sb {
+		inB[s] = true
+	}
+	var kept []clipEdge
+	for _, s := range sa {
+		switch {
+		case inB[s]:
+			kept = append(kept, s)
+		case inB[clipEdge{s.b, s.a}]:
+		case polygonContains(b, midPoint(s)):
+			kept = append(kept, s)
+		}
+	}
+	for _, s := range sb {
+		if inA[s] || inA[clipEdge{s.b, s.a}] {
+			continue
+		}
+		if polygonContains(a, midPoint(s)) {
+			kept = append(kept, s)
+		}
+	}
+	return assemblePolygons(chainEdges(kept))
+}
+
+// orientPolygon 外环面积为正, 内环为负
+func orientPolygon(p orb.Polygon) orb.Polygon {
+	out := make(orb.Polygon, 0, len(p))
+	for i, r := range p {
+		if len(r) < 3 {
+			continue
+		}
+		area := ringArea(r)
+		if (i == 0) != (area > 0) {
+			r = reverseRing(r)
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// ringEdges 环的各边, 忽略零长度边
+func ringEdges(r orb.Ring) []clipEdge {
+	var edges []clipEdge
+	n := len(r)
+	if n > 1 && r[0] == r[n-1] {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		a, b := r[i], r[(i+1)%n]
+		if a != b {
+			edges = append(edges, clipEdge{a, b})
+		}
+	}
+	return edges
+}
+
+type edgeCut struct {
+	t float64
+	p orb.Point
+}
+
+// splitEdge 在与others的交点处打断边
+func splitEdge(e clipEdge, others []clipEdge) []clipEdge {
+	cuts, _ := edgeCuts([]clipEdge{e}, others)
+	return splitAt(e, cuts[0])
+}
+
+// edgeCuts 两组边的交点, 每对边的交点只计算一次, 两边在同一点打断
+func edgeCuts(ea, eb []clipEdge) (ca, cb [][]edgeCut) {
+	ca = make([][]edgeCut, len(ea))
+	cb = make([][]edgeCut, len(eb))
+	for i, e := range ea {
+		minX, maxX := math.Min(e.a[0], e.b[0]), math.Max(e.a[0], e.b[0])
+		minY, maxY := math.Min(e.a[1], e.b[1]), math.Max(e.a[1], e.b[1])
+		for j, o := range eb {
+			if math.Max(o.a[0], o.b[0]) < minX || math.Min(o.a[0], o.b[0]) > maxX ||
+				math.Max(o.a[1], o.b[1]) < minY || math.Min(o.a[1], o.b[1]) > maxY {
+				continue
+			}
+			t, u, p, ok := segmentIntersection(e, o)
+			if !ok {
+				//共线重叠时在对方的端点处打断
+				ce, co := collinearCuts(e, o)
+				ca[i] = append(ca[i], ce...)
+				cb[j] = append(cb[j], co...)
+				continue
+			}
+			if t > 0 && t < 1 {
+				ca[i] = append(ca[i], edgeCut{t, p})
+			}
+			if u > 0 && u < 1 {
+				cb[j] = append(cb[j], edgeCut{u, p})
+			}
+		}
+	}
+	return ca, cb
+}
+
+// splitAt 按交点打断边
+func splitAt(e clipEdge, cuts []edgeCut) []clipEdge {
+	if len(cuts) == 0 {
+		return []clipEdge{e}
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i].t < cuts[j].t })
+	out := make([]clipEdge, 0, len(cuts)+1)
+	prev := e.a
+	for _, c := range cuts {
+		if c.p != prev {
+			out = append(out, clipEdge{prev, c.p})
+			prev = c.p
+		}
+	}
+	if prev != e.b {
+		out = append(out, clipEdge{prev, e.b})
+	}
+	return out
+}
+
+// collinearCuts 共线的两边互相在落在对方内部的端点处打断
+func collinearCuts(e, o clipEdge) (ce, co []edgeCut) {
+	if edgeCross(e, o.a) != 0 || edgeCross(e, o.b) != 0 {
+		return nil, nil
+	}
+	for _, p := range []orb.Point{o.a, o.b} {
+		if t := edgeParam(e, p); t > 0 && t < 1 {
+			ce = append(ce, edgeCut{t, p})
+		}
+	}
+	for _, p := range []orb.Point{e.a, e.b} {
+		if u := edgeParam(o, p); u > 0 && u < 1 {
+			co = append(co, edgeCut{u, p})
+		}
+	}
+	return ce, co
+}
+
+// onEdges 线段是否位于某条边上
+func onEdges(s clipEdge, edges []clipEdge) bool {
+	for _, e := range edges {
+		if edgeCross(e, s.a) != 0 || edgeCross(e, s.b) != 0 {
+			continue
+		}
+		if t := edgeParam(e, midPoint(s)); t >= 0 && t <= 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// edgeCross 点相对边的叉积, 为0时共线
+func edgeCross(e clipEdge, p orb.Point) float64 {
+	return (e.b[0]-e.a[0])*(p[1]-e.a[1]) - (e.b[1]-e.a[1])*(p[0]-e.a[0])
+}
+
+// edgeParam 共线点在边上的位置, 0、1为两端点
+func edgeParam(e clipEdge, p orb.Point) float64 {
+	dx, dy := e.b[0]-e.a[0], e.b[1]-e.a[1]
+	return ((p[0]-e.a[0])*dx + (p[1]-e.a[1])*dy) / (dx*dx + dy*dy)
+}
+
+// segmentIntersection 线段交点及在e、o上的位置, 端点落在另一线段上时取端点本身, 平行或共线时返回false
+func segmentIntersection(e, o clipEdge) (t, u float64, p orb.Point, ok bool) {
+	dx1, dy1 := e.b[0]-e.a[0], e.b[1]-e.a[1]
+	dx2, dy2 := o.b[0]-o.a[0], o.b[1]-o.a[1]
+	den := dx1*dy2 - dy1*dx2
+	if den == 0 {
+		return 0, 0, p, false
+	}
+	ox, oy := o.a[0]-e.a[0], o.a[1]-e.a[1]
+	t = (ox*dy2 - oy*dx2) / den
+	u = (ox*dy1 - oy*dx1) / den
+	if t < 0 || t > 1 || u < 0 || u > 1 {
+		return 0, 0, p, false
+	}
+	switch {
+	case u == 0:
+		p = o.a
+	case u == 1:
+		p = o.b
+	case t == 0:
+		p = e.a
+	case t == 1:
+		p = e.b
+	default:
+		p = orb.Point{e.a[0] + t*dx1, e.a[1] + t*dy1}
+	}
+	return t, u, p, true
+}
+
+// chainEdges 首尾相连组成闭合环, 无法闭合的边丢弃
+func chainEdges(edges []clipEdge) []orb.Ring {
+	starts := make(map[orb.Point][]int, len(edges))
+	for i, e := range edges {
+		starts[e.a] = append(starts[e.a], i)
+	}
+	used := make([]bool, len(edges))
+	next := func(p orb.Point) int {
+		for _, i := range starts[p] {
+			if !used[i] {
+				return i
+			}
+		}
+		return -1
+	}
+	var rings []orb.Ring
+	for i := range edges {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+		r := orb.Ring{edges[i].a, edges[i].b}
+		for r[len(r)-1] != r[0] {
+			j := next(r[len(r)-1])
+			if j < 0 {
+				break
+			}
+			used[j] = true
+			r = append(r, edges[j].b)
+		}
+		if r[len(r)-1] == r[0] && len(r) > 3 {
+			rings = append(rings, r)
+		}
+	}
+	return rings
+}
+
+// assemblePolygons 面积为正的环作为外环, 为负的作为内环归入包含它的最小外环
+func assemblePolygons(rings []orb.Ring) []orb.Polygon {
+	var polygons []orb.Polygon
+	var areas []float64
+	var holes []orb.Ring
+	for _, r := range rings {
+		area := ringArea(r)
+		if area > 0 {
+			polygons = append(polygons, orb.Polygon{r})
+			areas = append(areas, area)
+		} else if area < 0 {
+			holes = append(holes, r)
+		}
+	}
+	for _, h := range holes {
+		best := -1
+		p := midPoint(clipEdge{h[0], h[1]})
+		for i, poly := range polygons {
+			if ringContains(poly[0], p) && (best < 0 || areas[i] < areas[best]) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			polygons[best] = append(polygons[best], h)
+		}
+	}
+	return polygons
+}
+
+// polygonContains 点是否在面内, 奇偶规则
+func polygonContains(p orb.Polygon, pt orb.Point) bool {
+	in := false
+	for _, r := range p {
+		if ringContains(r, pt) {
+			in = !in
+		}
+	}
+	return in
+}
+
+// ringContains 射线法判断点是否在环内
+func ringContains(r orb.Ring, pt orb.Point) bool {
+	in := false
+	n := len(r)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		a, b := r[i], r[j]
+		if (a[1] > pt[1]) != (b[1] > pt[1]) &&
+			pt[0] < (b[0]-a[0])*(pt[1]-a[1])/(b[1]-a[1])+a[0] {
+			in = !in
+		}
+	}
+	return in
+}
+
+// ringArea 环的有向面积
+func ringArea(r orb.Ring) float64 {
+	area := 0.0
+	n := len(r)
+	for i := 0; i < n; i++ {
+		a, b := r[i], r[(i+1)%n]
+		area += a[0]*b[1] - b[0]*a[1]
+	}
+	return area / 2
+}
+
+func reverseRing(r orb.Ring) orb.Ring {
+	out := make(orb.Ring, len(r))
+	for i, p := range r {
+		out[len(r)-1-i] = p
+	}
+	return out
+}
+
+func midPoint(e clipEdge) orb.Point {
+	return orb.Point{(e.a[0] + e.b[0]) / 2, (e.a[1] + e.b[1]) / 2}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+// rect 矩形面
+func rect(minX, minY, maxX, maxY float64) orb.Polygon {
+	return orb.Polygon{{{minX, minY}, {maxX, minY}, {maxX, maxY}, {minX, maxY}, {minX, minY}}}
+}
+
+// polygonsArea 面的总面积, 内环为负
+func polygonsArea(ps []orb.Polygon) float64 {
+	area := 0.0
+	for _, p := range ps {
+		for _, r := range p {
+			area += ringArea(r)
+		}
+	}
+	return area
+}
+
+func TestIntersectPolygon(t *testing.T) {
+	//U形凹面, 开口向上
+	u := orb.Polygon{{{0, 0}, {3, 0}, {3, 3}, {2, 3}, {2, 1}, {1, 1}, {1, 3}, {0, 3}, {0, 0}}}
+	holed := orb.Polygon{rect(0, 0, 4, 4)[0], rect(1, 1, 3, 3)[0]}
+	cases := []struct {
+		name    string
+		subject orb.Polygon
+		clip    orb.Polygon
+		area    float64
+		count   int
+	}{
+		{"overlap", rect(0, 0, 2, 2), rect(1, 1, 3, 3), 1, 1},
+		{"disjoint", rect(0, 0, 1, 1), rect(2, 2, 3, 3), 0, 0},
+		{"concave split in two", u, rect(-1, 2, 4, 4), 2, 2},
+		{"concave clip", rect(-1, 2, 4, 4), u, 2, 2},
+		{"holed subject", holed, rect(2, 2, 5, 5), 3, 1},
+		{"clip inside hole", holed, rect(1.5, 1.5, 2.5, 2.5), 0, 0},
+		{"holed clip", rect(0, 0, 4, 4), holed, 12, 1},
+		{"identical", rect(0, 0, 2, 2), rect(0, 0, 2, 2), 4, 1},
+		{"shared edge outside", rect(0, 0, 1, 1), rect(1, 0, 2, 1), 0, 0},
+		{"shared partial edge", rect(0, 0, 2, 2), rect(0, 0, 1, 3), 2, 1},
+		{"shared edge inside", rect(0, 0, 4, 4), rect(0, 1, 2, 3), 4, 1},
+		{"collinear overlap", rect(0, 0, 2, 1), rect(1, 0, 3, 2), 1, 1},
+		{"edge on hole boundary", holed, rect(1, 0, 3, 1), 2, 1},
+		{"concave shared edges", u, rect(0, 0, 3, 1), 3, 1},
+	}
+	for _, c := range cases {
+		got := intersectPolygon(c.subject, c.clip)
+		if a := polygonsArea(got); math.Abs(a-c.area) > 1e-9 || len(got) != c.count {
+			t.Errorf("%s: got %d polygons of area %v, want %d of area %v: %v", c.name, len(got), a, c.count, c.area, got)
+		}
+	}
+}
+
+func TestIntersectPolygonHole(t *testing.T) {
+	holed := orb.Polygon{rect(0, 0, 4, 4)[0], rect(1, 1, 3, 3)[0]}
+	got := intersectPolygon(holed, rect(-1, -1, 5, 5))
+	if len(got) != 1 || len(got[0]) != 2 {
+		t.Fatalf("got %v, want the holed polygon", got)
+	}
+	if polygonContains(got[0], orb.Point{2, 2}) || !polygonContains(got[0], orb.Point{0.5, 0.5}) {
+		t.Errorf("hole lost: %v", got)
+	}
+}
+
+func TestClipLineString(t *testing.T) {
+	clips := []orb.Polygon{rect(0, 0, 2, 2)}
+	cases := []struct {
+		name string
+		ls   orb.LineString
+		want float64 //面内的长度
+	}{
+		{"crossing", orb.LineString{{-1, 1}, {3, 1}}, 2},
+		{"outside", orb.LineString{{-1, 3}, {3, 3}}, 0},
+		{"on boundary", orb.LineString{{0, 0}, {2, 0}}, 2},
+		{"along boundary", orb.LineString{{-1, 2}, {3, 2}}, 2},
+		{"in and out", orb.LineString{{1, 1}, {1, 3}, {1.5, 3}, {1.5, 1}}, 2},
+	}
+	for _, c := range cases {
+		length := 0.0
+		for _, ls := range clipLineString(c.ls, clips) {
+			for i := 0; i+1 < len(ls); i++ {
+				length += math.Hypot(ls[i+1][0]-ls[i][0], ls[i+1][1]-ls[i][1])
+			}
+		}
+		if math.Abs(length-c.want) > 1e-9 {
+			t.Errorf("%s: got length %v, want %v", c.name, length, c.want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// circleSegments 圆转为多边形的边数
+const circleSegments = 128
+
+// Region 除GeoJSON外的图层范围, bbox、tiles、center+radius
+type Region struct {
+	Bbox   []float64 //[minlon, minlat, maxlon, maxlat]
+	Tiles  []string  //瓦片行列号范围, 如"12/3400-3420/1600-1610"
+	Center []float64 //[lon, lat], 与Radius一起使用
+	Radius string    //半径, 如"10km"
+}
+
+// Build 生成图层范围, load为空时表示未配置geojson; geojson、bbox、tiles、center只能设置一种
+// tiles生成的范围同时返回瓦片行列号范围, 按级别换算后直接生成瓦片
+func (r Region) Build(load func() (orb.Collection, error)) (orb.Collection, []TileRange, error) {
+	n := 0
+	for _, set := range []bool{load != nil, len(r.Bbox) > 0, len(r.Tiles) > 0, len(r.Center) > 0} {
+		if set {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, nil, fmt.Errorf("one of geojson, bbox, tiles or center is required")
+	}
+	if n > 1 {
+		return nil, nil, fmt.Errorf("only one of geojson, bbox, tiles or center can be set")
+	}
+	switch {
+	case load != nil:
+		c, err := load()
+		return c, nil, err
+	case len(r.Bbox) > 0:
+		b, err := parseBbox(r.Bbox)
+		if err != nil {
+			return nil, nil, err
+		}
+		return orb.Collection{b.ToPolygon()}, nil, nil
+	case len(r.Tiles) > 0:
+		var c orb.Collection
+		var ranges []TileRange
+		for _, s := range r.Tiles {
+			rng, err := parseTileRange(s)
+			if err != nil {
+				return nil, nil, err
+			}
+			ranges = append(ranges, rng)
+			c = append(c, rng.Bound().ToPolygon())
+		}
+		return c, ranges, nil
+	default:
+		if len(r.Center) != 2 {
+			return nil, nil, fmt.Errorf("center must be [lon, lat]")
+		}
+		radius, err := parseDistance(r.Radius)
+		if err != nil {
+			return nil, nil, err
+		}
+		if radius.Tiles || radius.IsZero() {
+			return nil, nil, fmt.Errorf("radius must be a distance in metres, such as \"10km\"")
+		}
+		center := orb.Point{r.Center[0], r.Center[1]}
+		return orb.Collection{circlePolygon(center, radius.Value)}, nil, nil
+	}
+}
+
+// parseBbox 解析[minlon, minlat, maxlon, maxlat]
+func parseBbox(v []float64) (orb.Bound, error) {
+	if len(v) != 4 {
+		return orb.Bound{}, fmt.Errorf("bbox must be [minlon, minlat, maxlon, maxlat]")
+	}
+	b := orb.Bound{Min: orb.Point{v[0], v[1]}, Max: orb.Point{v[2], v[3]}}
+	if b.Min[0] >= b.Max[0] || b.Min[1] >= b.Max[1] ||
+		b.Min[0] < -180 || b.Max[0] > 180 || b.Min[1] < -90 || b.Max[1] > 90 {
+		return orb.Bound{}, fmt.Errorf("invalid bbox %v", v)
+	}
+	return b, nil
+}
+
+// circlePolygon 以center为圆心、radius米为半径的圆, 多边形外切于圆, 逆时针
+func circlePolygon(center orb.Point, radius float64) orb.Polygon {
+	d := radius / math.Cos(math.Pi/circleSegments) / orb.EarthRadius
+	lon1, lat1 := center[0]*math.Pi/180, center[1]*math.Pi/180
+	ring := make(orb.Ring, 0, circleSegments+1)
+	for i := 0; i < circleSegments; i++ {
+		brg := -2 * math.Pi * float64(i) / circleSegments
+		lat2 := math.Asin(math.Sin(lat1)*math.Cos(d) + math.Cos(lat1)*math.Sin(d)*math.Cos(brg))
+		lon2 := lon1 + math.Atan2(math.Sin(brg)*math.Sin(d)*math.Cos(lat1), math.Cos(d)-math.Sin(lat1)*math.Sin(lat2))
+		ring = append(ring, orb.Point{lon2 * 180 / math.Pi, lat2 * 180 / math.Pi})
+	}
+	ring = append(ring, ring[0])
+	return orb.Polygon{ring}
+}
+
+// TileRange 瓦片行列号范围, 行号为xyz
+type TileRange struct {
+	Z          maptile.Zoom
+	MinX, MaxX uint32
+	MinY, MaxY uint32
+}
+
+// parseTileRange 解析"z/x/y"范围, x、y可为单个行列号或"min-max"
+func parseTileRange(s string) (TileRange, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) != 3 {
+		return TileRange{}, fmt.Errorf("invalid tile range %q, want z/x/y", s)
+	}
+	z, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil || z > 30 {
+		return TileRange{}, fmt.Errorf("invalid zoom of tile range %q", s)
+	}
+	max := uint64(1)<<z - 1
+	span := func(v string) (uint32, uint32, error) {
+		lo, hi := v, v
+		if i := strings.Index(v, "-"); i >= 0 {
+			lo, hi = v[:i], v[i+1:]
+		}
+		a, err1 := strconv.ParseUint(strings.TrimSpace(lo), 10, 32)
+		b, err2 := strconv.ParseUint(strings.TrimSpace(hi), 10, 32)
+		if err1 != nil || err2 != nil || a > b || b > max {
+			return 0, 0, fmt.Errorf("invalid tile range %q", s)
+		}
+		return uint32(a), uint32(b), nil
+	}
+	r := TileRange{Z: maptile.Zoom(z)}
+	if r.MinX, r.MaxX, err = span(parts[1]); err != nil {
+		return TileRange{}, err
+	}
+	if r.MinY, r.MaxY, err = span(parts[2]); err != nil {
+		return TileRange{}, err
+	}
+	return r, nil
+}
+
+// At 换算到z级, 高级别为全部子瓦片, 低级别为所在的父瓦片
+func (r TileRange) At(z maptile.Zoom) TileRange {
+	if z >= r.Z {
+		d := z - r.Z
+		return TileRange{Z: z, MinX: r.MinX << d, MaxX: (r.MaxX+1)<<d - 1, MinY: r.MinY << d, MaxY: (r.MaxY+1)<<d - 1}
+	}
+	d := r.Z - z
+	return TileRange{Z: z, MinX: r.MinX >> d, MaxX: r.MaxX >> d, MinY: r.MinY >> d, MaxY: r.MaxY >> d}
+}
+
+// Contains 瓦片是否在范围内
+func (r TileRange) Contains(x, y uint32) bool {
+	return x >= r.MinX && x <= r.MaxX && y >= r.MinY && y <= r.MaxY
+}
+
+// Bound 范围的经纬度
+func (r TileRange) Bound() orb.Bound {
+	return maptile.New(r.MinX, r.MinY, r.Z).Bound().Union(maptile.New(r.MaxX, r.MaxY, r.Z).Bound())
+}
+
+// rangesAt 各范围换算到z级
+func rangesAt(ranges []TileRange, z maptile.Zoom) []TileRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	out := make([]TileRange, len(ranges))
+	for i, r := range ranges {
+		out[i] = r.At(z)
+	}
+	return out
+}
+
+// rangeCount 各范围的瓦片数, 重叠部分只计一次
+func rangeCount(ranges []TileRange) int64 {
+	var n int64
+	for i, r := range ranges {
+		for y := uint64(r.MinY); y <= uint64(r.MaxY); y++ {
+			//该行中已被之前的范围包含的列
+			var spans [][2]uint32
+			for _, o := range ranges[:i] {
+				if uint32(y) >= o.MinY && uint32(y) <= o.MaxY && o.MaxX >= r.MinX && o.MinX <= r.MaxX {
+					spans = append(spans, [2]uint32{maxUint32(o.MinX, r.MinX), minUint32(o.MaxX, r.MaxX)})
+				}
+			}
+			n += int64(r.MaxX-r.MinX) + 1 - spanLength(spans)
+		}
+	}
+	return n
+}
+
+// spanLength 闭区间并集的长度
+func spanLength(spans [][2]uint32) int64 {
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	var n int64
+	next := int64(-1) //已计入的最大列号
+	for _, s := range spans {
+		lo, hi := int64(s[0]), int64(s[1])
+		if lo <= next {
+			lo = next + 1
+		}
+		if hi >= lo {
+			n += hi - lo + 1
+			next = hi
+		}
+	}
+	return n
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxUint32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/spf13/viper"
+)
+
+// StatusError 非200响应错误
+type StatusError struct {
+	Code       int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code: %d", e.Code)
+}
+
+// RetryPolicy 重试策略
+type RetryPolicy struct {
+	Retries    int
+	Base       time.Duration
+	Max        time.Duration
+	RetryCodes map[int]bool
+}
+
+// NewRetryPolicy 从配置创建重试策略
+func NewRetryPolicy() RetryPolicy {
+	p := RetryPolicy{
+		Retries:    viper.GetInt("task.retries"),
+		Base:       time.Duration(viper.GetInt("task.backoff")) * time.Millisecond,
+		Max:        time.Duration(viper.GetInt("task.backoffmax")) * time.Millisecond,
+		RetryCodes: make(map[int]bool),
+	}
+	for _, code := range viper.GetIntSlice("task.retrycodes") {
+		p.RetryCodes[code] = true
+	}
+	return p
+}
+
+// Retryable 错误是否可重试, 网络错误总是可重试
+func (p RetryPolicy) Retryable(err error) bool {
+	if se, ok := err.(*StatusError); ok {
+		return p.RetryCodes[se.Code]
+	}
+	return true
+}
+
+// Backoff 第attempt次重试前的等待时间, 指数退避加随机抖动, 服务端给出Retry-After时以其为准, 但不超过Max, Max<=0时不设上限
+func (p RetryPolicy) Backoff(attempt int, err error) time.Duration {
+	if se, ok := err.(*StatusError); ok && se.RetryAfter > 0 {
+		if p.Max > 0 && se.RetryAfter > p.Max {
+			return p.Max
+		}
+		return se.RetryAfter
+	}
+	if p.Base <= 0 {
+		return 0
+	}
+	d := p.Base << uint(attempt)
+	//移位溢出或超过上限时取上限, Max<=0时不设上限
+	if p.Max > 0 && (d <= 0 || d > p.Max) {
+		d = p.Max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter 解析Retry-After头, 支持秒数和HTTP日期
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// writeTileList 写出瓦片列表, 每行z/x/y
+func writeTileList(file string, set maptile.Set) error {
+	tiles := make(maptile.Tiles, 0, len(set))
+	for t := range set {
+		tiles = append(tiles, t)
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].Z != tiles[j].Z {
+			return tiles[i].Z < tiles[j].Z
+		}
+		if tiles[i].X != tiles[j].X {
+			return tiles[i].X < tiles[j].X
+		}
+		return tiles[i].Y < tiles[j].Y
+	})
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, t := range tiles {
+		fmt.Fprintf(w, "%d/%d/%d\n", t.Z, t.X, t.Y)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// loadTileList 读取瓦片列表, 按级别分组
+func loadTileList(file string) (map[int]maptile.Tiles, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list := make(map[int]maptile.Tiles)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var z, x, y uint32
+		_, err := fmt.Sscanf(line, "%d/%d/%d", &z, &x, &y)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		list[int(z)] = append(list[int(z)], maptile.New(x, y, maptile.Zoom(z)))
+	}
+	return list, scanner.Err()
+}
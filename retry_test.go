@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   RetryPolicy
+		attempt  int
+		err      error
+		min, max time.Duration
+	}{
+		{"first", RetryPolicy{Base: 100 * time.Millisecond, Max: time.Second}, 0, nil, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"exponential", RetryPolicy{Base: 100 * time.Millisecond, Max: time.Second}, 2, nil, 200 * time.Millisecond, 400 * time.Millisecond},
+		{"capped", RetryPolicy{Base: 100 * time.Millisecond, Max: time.Second}, 5, nil, 500 * time.Millisecond, time.Second},
+		{"overflow capped", RetryPolicy{Base: 100 * time.Millisecond, Max: time.Second}, 62, nil, 500 * time.Millisecond, time.Second},
+		{"no cap", RetryPolicy{Base: 100 * time.Millisecond}, 5, nil, 1600 * time.Millisecond, 3200 * time.Millisecond},
+		{"no base", RetryPolicy{Max: time.Second}, 3, nil, 0, 0},
+		{"retry after", RetryPolicy{Base: 100 * time.Millisecond, Max: time.Minute}, 0, &StatusError{Code: 429, RetryAfter: 5 * time.Second}, 5 * time.Second, 5 * time.Second},
+		{"retry after capped", RetryPolicy{Base: 100 * time.Millisecond, Max: time.Second}, 0, &StatusError{Code: 429, RetryAfter: time.Hour}, time.Second, time.Second},
+		{"retry after no cap", RetryPolicy{Base: 100 * time.Millisecond}, 0, &StatusError{Code: 503, RetryAfter: time.Hour}, time.Hour, time.Hour},
+		{"status without retry after", RetryPolicy{Base: 100 * time.Millisecond, Max: time.Second}, 1, &StatusError{Code: 500}, 100 * time.Millisecond, 200 * time.Millisecond},
+	}
+	for _, c := range cases {
+		for i := 0; i < 20; i++ {
+			if d := c.policy.Backoff(c.attempt, c.err); d < c.min || d > c.max {
+				t.Errorf("%s: backoff = %v, want in [%v, %v]", c.name, d, c.min, c.max)
+				break
+			}
+		}
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	p := RetryPolicy{RetryCodes: map[int]bool{429: true, 503: true}}
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&StatusError{Code: 429}, true},
+		{&StatusError{Code: 503}, true},
+		{&StatusError{Code: 404}, false},
+		{&StatusError{Code: 500}, false},
+		{errors.New("connection reset by peer"), true},
+	}
+	for _, c := range cases {
+		if got := p.Retryable(c.err); got != c.want {
+			t.Errorf("retryable(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	cases := []struct {
+		v        string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"120", 2 * time.Minute, 2 * time.Minute},
+		{" 3 ", 3 * time.Second, 3 * time.Second},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+	}
+	for _, c := range cases {
+		if d := parseRetryAfter(c.v); d < c.min || d > c.max {
+			t.Errorf("parseRetryAfter(%q) = %v, want in [%v, %v]", c.v, d, c.min, c.max)
+		}
+	}
+	//已过去的日期无需等待
+	if d := parseRetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)); d > 0 {
+		t.Errorf("past date = %v, want <= 0", d)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb/maptile"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// s3ContentTypes 瓦片格式对应的Content-Type
+var s3ContentTypes = map[string]string{
+	PNG:  "image/png",
+	JPG:  "image/jpeg",
+	WEBP: "image/webp",
+	PBF:  "application/x-protobuf",
+}
+
+// S3Store S3兼容对象存储, 瓦片上传为{prefix}/{z}/{x}/{y}.{format}
+type S3Store struct {
+	Endpoint    string //如http://127.0.0.1:9000
+	Region      string
+	Bucket      string
+	Prefix      string
+	AccessKey   string
+	SecretKey   string
+	PathStyle   bool //路径方式访问bucket, MinIO需开启
+	Concurrency int  //每批次并发上传数
+	Format      string
+	TMS         bool
+	Keep        bool //合并已有元数据
+	Retry       RetryPolicy
+	Ctx         context.Context //任务取消时停止重试等待
+	client      *http.Client
+	endpoint    *url.URL
+}
+
+// NewS3Store 从配置创建S3存储, 未配置密钥时读取AWS_ACCESS_KEY_ID、AWS_SECRET_ACCESS_KEY环境变量
+func NewS3Store(format string, tms, keep bool) *S3Store {
+	s := &S3Store{
+		Endpoint:    viper.GetString("output.s3.endpoint"),
+		Region:      viper.GetString("output.s3.region"),
+		Bucket:      viper.GetString("output.s3.bucket"),
+		Prefix:      strings.Trim(viper.GetString("output.s3.prefix"), "/"),
+		AccessKey:   viper.GetString("output.s3.accesskey"),
+		SecretKey:   viper.GetString("output.s3.secretkey"),
+		PathStyle:   viper.GetBool("output.s3.pathstyle"),
+		Concurrency: viper.GetInt("output.s3.concurrency"),
+		Format:      format,
+		TMS:         tms,
+		Keep:        keep,
+		Retry:       NewRetryPolicy(),
+	}
+	if s.AccessKey == "" {
+		s.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	return s
+}
+
+// Open 解析endpoint并检查bucket是否可访问
+func (s *S3Store) Open() error {
+	if s.Bucket == "" {
+		return fmt.Errorf("output.s3.bucket not set")
+	}
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid s3 endpoint %q", s.Endpoint)
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.Concurrency < 1 {
+		s.Concurrency = 1
+	}
+	s.endpoint = u
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = s.Concurrency
+	s.client = &http.Client{Transport: transport, Timeout: time.Minute}
+	resp, err := s.do(http.MethodHead, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) key(t maptile.Tile) string {
+	y := t.Y
+	if s.TMS {
+		y = Tile{T: t}.flipY()
+	}
+	return s.object(fmt.Sprintf("%d/%d/%d.%s", t.Z, t.X, y, s.Format))
+}
+
+func (s *S3Store) object(name string) string {
+	if s.Prefix == "" {
+		return name
+	}
+	return s.Prefix + "/" + name
+}
+
+// url 对象地址, 路径方式为endpoint/bucket/key, 否则为bucket.endpoint/key
+func (s *S3Store) url(key string) *url.URL {
+	u := *s.endpoint
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	return &u
+}
+
+// s3EscapePath 按签名规范编码路径, 仅保留非保留字符及/
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// do 发送签名请求, 非2xx响应返回StatusError
+func (s *S3Store) do(method, key string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(key).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+	}
+	s.sign(req, body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if len(msg) > 0 && method != http.MethodHead {
+			log.Debugf("s3 %s %s: %s", method, key, msg)
+		}
+		return nil, &StatusError{Code: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return resp, nil
+}
+
+// putObject 上传对象, 失败时按重试策略重试
+func (s *S3Store) putObject(key string, body []byte, header http.Header) error {
+	for attempt := 0; ; attempt++ {
+		resp, err := s.do(http.MethodPut, key, body, header)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			return resp.Body.Close()
+		}
+		//任务取消时仍上传已下载的瓦片, 但不再等待重试, 失败的瓦片留待续传
+		if attempt >= s.Retry.Retries || !s.Retry.Retryable(err) {
+			return err
+		}
+		wait := s.Retry.Backoff(attempt, err)
+		log.Warnf("upload %s error ~ %s, retry in %v", key, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-s.done():
+			return err
+		}
+	}
+}
+
+// done 任务取消信号, 未设置Ctx时不会取消
+func (s *S3Store) done() <-chan struct{} {
+	if s.Ctx == nil {
+		return nil
+	}
+	return s.Ctx.Done()
+}
+
+// Put 上传瓦片, pbf瓦片已gzip压缩
+func (s *S3Store) Put(tile Tile) error {
+	header := make(http.Header)
+	if ct, ok := s3ContentTypes[s.Format]; ok {
+		header.Set("Content-Type", ct)
+	}
+	if s.Format == PBF {
+		header.Set("Content-Encoding", "gzip")
+	}
+	//校验信息保存为对象元数据
+	if tile.V.ETag != "" {
+		header.Set("X-Amz-Meta-Source-Etag", tile.V.ETag)
+	}
+	if tile.V.LastModified != "" {
+		header.Set("X-Amz-Meta-Source-Last-Modified", tile.V.LastModified)
+	}
+	if tile.V.Hash != "" {
+		header.Set("X-Amz-Meta-Source-Hash", tile.V.Hash)
+	}
+	return s.putObject(s.key(tile.T), tile.C, header)
+}
+
+// Validator 从对象元数据读取校验信息
+func (s *S3Store) Validator(t maptile.Tile) (Validator, error) {
+	var v Validator
+	resp, err := s.do(http.MethodHead, s.key(t), nil, nil)
+	if se, ok := err.(*StatusError); ok && se.Code == http.StatusNotFound {
+		return v, nil
+	}
+	if err != nil {
+		return v, err
+	}
+	resp.Body.Close()
+	v.ETag = resp.Header.Get("X-Amz-Meta-Source-Etag")
+	v.LastModified = resp.Header.Get("X-Amz-Meta-Source-Last-Modified")
+	v.Hash = resp.Header.Get("X-Amz-Meta-Source-Hash")
+	return v, nil
+}
+
+// PutBatch 并发上传一批瓦片
+func (s *S3Store) PutBatch(tiles []Tile) map[maptile.Tile]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(map[maptile.Tile]error)
+	sem := make(chan struct{}, s.Concurrency)
+	for _, tile := range tiles {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(tile Tile) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := s.Put(tile)
+			if err != nil {
+				mu.Lock()
+				errs[tile.T] = err
+				mu.Unlock()
+			}
+		}(tile)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Has 对象是否已存在
+func (s *S3Store) Has(t maptile.Tile) (bool, error) {
+	resp, err := s.do(http.MethodHead, s.key(t), nil, nil)
+	if se, ok := err.(*StatusError); ok && se.Code == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// Get 下载对象
+func (s *S3Store) Get(t maptile.Tile) ([]byte, error) {
+	return s.getObject(s.key(t))
+}
+
+func (s *S3Store) getObject(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil)
+	if se, ok := err.(*StatusError); ok && se.Code == http.StatusNotFound {
+		return nil, ErrTileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// WriteMetadata 元数据上传为{prefix}/metadata.json
+func (s *S3Store) WriteMetadata(meta map[string]string) error {
+	key := s.object("metadata.json")
+	if s.Keep {
+		var old map[string]string
+		data, err := s.getObject(key)
+		if err == nil && json.Unmarshal(data, &old) == nil {
+			meta = mergeMeta(old, meta)
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(meta)
+	if err != nil {
+		return err
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	return s.putObject(key, buf.Bytes(), header)
+}
+
+// Close 关闭空闲连接
+func (s *S3Store) Close() error {
+	if s.client != nil {
+		s.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// sign AWS Signature V4签名, 未配置accesskey时匿名访问
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	if s.AccessKey == "" {
+		return
+	}
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "content-type" || k == "content-encoding" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// fakeS3 进程内S3服务, 校验签名, 记录上传的对象, 前fail次PUT返回503
+type fakeS3 struct {
+	sync.Mutex
+	secret  string
+	denied  []string //签名校验失败的请求
+	fail    int
+	puts    int
+	objects map[string][]byte
+	headers map[string]http.Header
+}
+
+func newFakeS3(secret string, fail int) *fakeS3 {
+	return &fakeS3{secret: secret, fail: fail, objects: make(map[string][]byte), headers: make(map[string]http.Header)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.Lock()
+	defer f.Unlock()
+	if err := f.verify(r, body); err != "" {
+		f.denied = append(f.denied, r.Method+" "+r.URL.Path+": "+err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		if r.URL.Path != "/tiles" {
+			if _, ok := f.objects[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		}
+	case http.MethodPut:
+		f.puts++
+		if f.puts <= f.fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		f.objects[r.URL.Path] = body
+		f.headers[r.URL.Path] = r.Header.Clone()
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// verify 按服务端收到的请求重新计算SigV4签名
+func (f *fakeS3) verify(r *http.Request, body []byte) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return "missing sigv4 authorization: " + auth
+	}
+	fields := make(map[string]string)
+	for _, kv := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		if i := strings.Index(kv, "="); i > 0 {
+			fields[kv[:i]] = kv[i+1:]
+		}
+	}
+	cred := strings.Split(fields["Credential"], "/")
+	if len(cred) != 5 || cred[0] != "AKID" || cred[2] != "us-east-1" || cred[3] != "s3" || cred[4] != "aws4_request" {
+		return "bad credential " + fields["Credential"]
+	}
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	if r.Header.Get("X-Amz-Content-Sha256") != payload {
+		return "payload hash mismatch"
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if !strings.HasPrefix(amzDate, cred[1]) {
+		return "x-amz-date does not match credential date"
+	}
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signed) {
+		return "signed headers not sorted"
+	}
+	var canonical strings.Builder
+	for _, k := range signed {
+		v := r.Header.Get(k)
+		if k == "host" {
+			v = r.Host
+		}
+		canonical.WriteString(k + ":" + strings.TrimSpace(v) + "\n")
+	}
+	for k := range r.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") && !strings.Contains(fields["SignedHeaders"], k) {
+			return k + " not signed"
+		}
+	}
+	request := strings.Join([]string{r.Method, r.URL.EscapedPath(), r.URL.Query().Encode(), canonical.String(), fields["SignedHeaders"], payload}, "\n")
+	hash := sha256.Sum256([]byte(request))
+	scope := strings.Join(cred[1:], "/")
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + f.secret)
+	for _, s := range []string{cred[1], cred[2], cred[3], cred[4], toSign} {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(s))
+		key = h.Sum(nil)
+	}
+	if hex.EncodeToString(key) != fields["Signature"] {
+		return "signature mismatch"
+	}
+	return ""
+}
+
+func newTestS3Store(endpoint string) *S3Store {
+	return &S3Store{
+		Endpoint:    endpoint,
+		Bucket:      "tiles",
+		Prefix:      "basemap",
+		AccessKey:   "AKID",
+		SecretKey:   "SECRET",
+		PathStyle:   true,
+		Concurrency: 4,
+		Format:      PBF,
+		Retry: RetryPolicy{
+			Retries:    3,
+			Base:       time.Millisecond,
+			Max:        10 * time.Millisecond,
+			RetryCodes: map[int]bool{http.StatusServiceUnavailable: true},
+		},
+	}
+}
+
+func TestS3StorePut(t *testing.T) {
+	fake := newFakeS3("SECRET", 2)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := newTestS3Store(srv.URL)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tile := Tile{
+		T: maptile.New(6, 2, 3),
+		C: []byte{0x1f, 0x8b, 0x08, 0x00},
+		V: Validator{ETag: `"abc"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT", Hash: "1234"},
+	}
+	//前两次返回503, 第三次成功
+	if err := s.Put(tile); err != nil {
+		t.Fatalf("put error: %s", err)
+	}
+	if len(fake.denied) > 0 {
+		t.Fatalf("requests denied: %v", fake.denied)
+	}
+	if fake.puts != 3 {
+		t.Errorf("puts = %d, want 3 with 2 retries", fake.puts)
+	}
+	path := "/tiles/basemap/3/6/2.pbf"
+	if string(fake.objects[path]) != string(tile.C) {
+		t.Fatalf("object %s not uploaded, got %v", path, fake.objects)
+	}
+	h := fake.headers[path]
+	want := map[string]string{
+		"Content-Type":                    "application/x-protobuf",
+		"Content-Encoding":                "gzip",
+		"X-Amz-Meta-Source-Etag":          `"abc"`,
+		"X-Amz-Meta-Source-Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT",
+		"X-Amz-Meta-Source-Hash":          "1234",
+	}
+	for k, v := range want {
+		if h.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, h.Get(k), v)
+		}
+	}
+	ok, err := s.Has(tile.T)
+	if err != nil || !ok {
+		t.Errorf("has uploaded tile = %v, %v", ok, err)
+	}
+	ok, err = s.Has(maptile.New(0, 0, 0))
+	if err != nil || ok {
+		t.Errorf("has missing tile = %v, %v", ok, err)
+	}
+}
+
+func TestS3StorePutRetriesExhausted(t *testing.T) {
+	fake := newFakeS3("SECRET", 100)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := newTestS3Store(srv.URL)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	err := s.Put(Tile{T: maptile.New(0, 0, 0), C: []byte("x")})
+	if se, ok := err.(*StatusError); !ok || se.Code != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, want status 503", err)
+	}
+	if fake.puts != 4 {
+		t.Errorf("puts = %d, want 4 (1 + 3 retries)", fake.puts)
+	}
+}
+
+func TestS3StorePutCancel(t *testing.T) {
+	fake := newFakeS3("SECRET", 100)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := newTestS3Store(srv.URL)
+	s.Retry.Base, s.Retry.Max = time.Minute, time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Ctx = ctx
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	//取消后不再等待重试间隔
+	if err := s.Put(Tile{T: maptile.New(0, 0, 0), C: []byte("x")}); err == nil {
+		t.Fatal("put should fail after cancel")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("put returned after %v, want it to stop on cancel", d)
+	}
+}
+
+func TestS3StoreBadSignature(t *testing.T) {
+	fake := newFakeS3("OTHER", 0)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := newTestS3Store(srv.URL)
+	err := s.Open()
+	if se, ok := err.(*StatusError); !ok || se.Code != http.StatusForbidden {
+		t.Fatalf("open with wrong secret err = %v, want 403", err)
+	}
+	if len(fake.denied) != 1 || !strings.Contains(fake.denied[0], "signature mismatch") {
+		t.Errorf("denied = %v, want a signature mismatch", fake.denied)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ErrOutputInUse 输出路径正被其他任务写入
+var ErrOutputInUse = errors.New("output in use")
+
+// Server 任务管理服务, 多任务并发下载, 共享全局workers
+type Server struct {
+	sync.RWMutex
+	tasks   map[string]*Task
+	order   []string
+	workers chan maptile.Tile
+	limiter *RateLimiter
+	wg      sync.WaitGroup
+	closing bool //服务退出中, 不再接受任务
+}
+
+// TaskRequest 提交任务参数
+type TaskRequest struct {
+	TM  TileMap
+	Lrs []struct {
+		Min          int
+		Max          int
+		URL          string
+		Subdomains   []string
+		Balance      string
+		MatrixPrefix string
+		Schema       string
+		Geojson      json.RawMessage
+		Where        string //筛选geojson中的要素
+		Buffer       string //外扩距离, 如"500m"、"1tile"
+		Simplify     string //简化容差, 单位同Buffer
+		Region              //geojson以外的范围
+		Source
+	}
+	Output TaskOutput
+}
+
+// TaskOutput 任务输出参数, 未设置的项使用配置文件中的[output]
+type TaskOutput struct {
+	Format    string //mbtiles、file、pmtiles、gpkg、s3
+	Directory string //须在配置的output.directory下
+	File      string //须在配置的output.directory下
+	Mode      string //overwrite、skip、update
+	Schema    string //xyz、tms
+	Dedupe    *bool
+}
+
+// apply 覆盖任务的输出参数
+func (o TaskOutput) apply(task *Task) error {
+	if o.Format != "" {
+		switch o.Format {
+		case "mbtiles", "file", "pmtiles", "gpkg", "s3":
+		default:
+			return fmt.Errorf("unknown output format %q", o.Format)
+		}
+		task.outformat = o.Format
+	}
+	if o.Mode != "" {
+		switch o.Mode {
+		case ModeOverwrite, ModeSkip, ModeUpdate:
+		default:
+			return fmt.Errorf("unknown output mode %q", o.Mode)
+		}
+		task.mode = o.Mode
+	}
+	if o.Schema != "" {
+		if o.Schema != "xyz" && o.Schema != "tms" {
+			return fmt.Errorf("unknown output schema %q", o.Schema)
+		}
+		task.outschema = o.Schema
+	}
+	if o.Directory != "" {
+		task.outdir = o.Directory
+		//指定目录时不使用配置文件中的固定路径
+		task.outfile = ""
+	}
+	if o.File != "" {
+		task.outfile = o.File
+	}
+	if o.Dedupe != nil {
+		task.dedupe = *o.Dedupe
+	}
+	return nil
+}
+
+// TaskStatus 任务状态
+type TaskStatus struct {
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	File      string      `json:"file"`
+	Min       int         `json:"min"`
+	Max       int         `json:"max"`
+	State     string      `json:"state"`
+	Total     int64       `json:"total"`
+	Current   int64       `json:"current"`
+	Failed    int         `json:"failed"`
+	Skipped   int64       `json:"skipped"`
+	Unchanged int64       `json:"unchanged"`
+	Blank     map[int]int `json:"blank"` //各级别空白瓦片数
+}
+
+// NewServer 创建任务管理服务
+func NewServer() *Server {
+	return &Server{
+		tasks:   make(map[string]*Task),
+		workers: make(chan maptile.Tile, viper.GetInt("server.workers")),
+		limiter: NewRateLimiter(),
+	}
+}
+
+// Status 任务状态
+func (task *Task) Status() TaskStatus {
+	task.tileSet.RLock()
+	failed := len(task.tileSet.M)
+	task.tileSet.RUnlock()
+	return TaskStatus{
+		ID:        task.ID,
+		Name:      task.Name,
+		File:      task.File,
+		Min:       task.Min,
+		Max:       task.Max,
+		State:     task.State(),
+		Total:     atomic.LoadInt64(&task.Total),
+		Current:   atomic.LoadInt64(&task.Current),
+		Failed:    failed,
+		Skipped:   atomic.LoadInt64(&task.skipped),
+		Unchanged: atomic.LoadInt64(&task.unchanged),
+		Blank:     task.blankCounts(),
+	}
+}
+
+// Submit 创建并开始任务
+func (s *Server) Submit(req TaskRequest) (*Task, error) {
+	var layers []Layer
+	for i, lrs := range req.Lrs {
+		var load func() (orb.Collection, error)
+		if len(lrs.Geojson) > 0 {
+			data := lrs.Geojson
+			where := lrs.Where
+			load = func() (orb.Collection, error) {
+				features, err := parseFeatures(data)
+				if err != nil {
+					return nil, fmt.Errorf("geojson error: %s", err)
+				}
+				return filterFeatures("geojson", features, where)
+			}
+		} else if lrs.Where != "" {
+			return nil, fmt.Errorf("lrs[%d] where requires geojson", i)
+		}
+		c, ranges, err := lrs.Region.Build(load)
+		if err != nil {
+			return nil, fmt.Errorf("lrs[%d] %s", i, err)
+		}
+		buffer, err := parseDistance(lrs.Buffer)
+		if err != nil {
+			return nil, fmt.Errorf("lrs[%d] buffer error: %s", i, err)
+		}
+		simplify, err := parseDistance(lrs.Simplify)
+		if err != nil {
+			return nil, fmt.Errorf("lrs[%d] simplify error: %s", i, err)
+		}
+		var src *Source
+		if !lrs.Source.Empty() {
+			src = &req.Lrs[i].Source
+			src.Inherit(&req.TM.Source)
+		}
+		for z := lrs.Min; z <= lrs.Max; z++ {
+			layers = append(layers, Layer{
+				URL:          lrs.URL,
+				Zoom:         z,
+				Collection:   c,
+				Ranges:       rangesAt(ranges, maptile.Zoom(z)),
+				Source:       src,
+				Subdomains:   lrs.Subdomains,
+				Balance:      lrs.Balance,
+				MatrixPrefix: lrs.MatrixPrefix,
+				Schema:       lrs.Schema,
+				Buffer:       buffer,
+				Simplify:     simplify,
+			})
+		}
+	}
+	if req.TM.Timeout == 0 {
+		req.TM.Timeout = viper.GetInt("tm.timeout")
+	}
+	task, err := NewTask(layers, req.TM)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Output.apply(task)
+	if err != nil {
+		return nil, err
+	}
+	task.workers = s.workers //使用全局workers
+	task.limiter = s.limiter //使用全局限速
+
+	//提交时确定输出路径, 与未结束的任务冲突时拒绝
+	task.File, err = task.outputFile()
+	if err != nil {
+		return nil, err
+	}
+	err = checkOutputPath(task.File)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	if s.closing {
+		s.Unlock()
+		return nil, fmt.Errorf("server is shutting down")
+	}
+	if other := s.writing(task.File); other != nil {
+		s.Unlock()
+		return nil, fmt.Errorf("%w: %s is used by task %s", ErrOutputInUse, task.File, other.ID)
+	}
+	s.tasks[task.ID] = task
+	s.order = append(s.order, task.ID)
+	s.wg.Add(1)
+	s.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		task.Download()
+	}()
+	return task, nil
+}
+
+// checkOutputPath 服务模式的输出路径须在配置的output.directory下, 或为配置的output.file
+// 接口无鉴权, 防止请求覆盖或删除任意文件
+func checkOutputPath(file string) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	if conf := viper.GetString("output.file"); conf != "" {
+		if f, err := filepath.Abs(conf); err == nil && f == abs {
+			return nil
+		}
+	}
+	root, err := filepath.Abs(viper.GetString("output.directory"))
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("output %s is outside the output directory %s", file, viper.GetString("output.directory"))
+	}
+	return nil
+}
+
+// writing 正在写入file的未结束任务, 调用方需持有锁
+func (s *Server) writing(file string) *Task {
+	abs, _ := filepath.Abs(file)
+	for _, task := range s.tasks {
+		switch atomic.LoadInt32(&task.state) {
+		case TaskAborted, TaskFinished, TaskFailed:
+			continue
+		}
+		if f, _ := filepath.Abs(task.File); f == abs {
+			return task
+		}
+	}
+	return nil
+}
+
+// Abort 取消全部任务并等待结束, 之后不再接受新任务
+func (s *Server) Abort() {
+	s.Lock()
+	s.closing = true
+	for _, task := range s.tasks {
+		task.abortFun()
+	}
+	s.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) task(id string) *Task {
+	s.RLock()
+	defer s.RUnlock()
+	return s.tasks[id]
+}
+
+// ServeHTTP 路由
+// POST /tasks 提交任务, GET /tasks 任务列表, GET /tasks/{id} 任务状态,
+// POST /tasks/{id}/pause|resume|abort 控制任务
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "tasks" {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.listTasks(w, r)
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		s.createTask(w, r)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		task := s.task(parts[1])
+		if task == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("task %s not found", parts[1]))
+			return
+		}
+		writeJSON(w, http.StatusOK, task.Status())
+	case len(parts) == 3 && r.Method == http.MethodPost:
+		s.controlTask(w, parts[1], parts[2])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s %s not allowed", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) listTasks(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	list := make([]TaskStatus, 0, len(s.order))
+	for _, id := range s.order {
+		list = append(list, s.tasks[id].Status())
+	}
+	s.RUnlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) createTask(w http.ResponseWriter, r *http.Request) {
+	var req TaskRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	task, err := s.Submit(req)
+	if errors.Is(err, ErrOutputInUse) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	log.Infof("task %s submitted, tiles: %d ~", task.ID, atomic.LoadInt64(&task.Total))
+	writeJSON(w, http.StatusCreated, task.Status())
+}
+
+func (s *Server) controlTask(w http.ResponseWriter, id, action string) {
+	task := s.task(id)
+	if task == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("task %s not found", id))
+		return
+	}
+	switch action {
+	case "pause":
+		task.pauseFun()
+	case "resume":
+		task.playFun()
+	case "abort":
+		task.abortFun()
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action %s", action))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, task.Status())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// serve 启动任务管理服务, 中断信号先取消全部任务并等待结束, 再关闭HTTP服务退出
+func serve() {
+	s := NewServer()
+	srv := &http.Server{
+		Addr:    viper.GetString("server.addr"),
+		Handler: s,
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := <-sigs
+		log.Warnf("got %s, aborting all tasks ~", sig)
+		s.Abort()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			log.Errorf("shutdown server error ~ %s", err)
+		}
+	}()
+	log.Infof("tiler serving on %s, workers: %d ~", srv.Addr, cap(s.workers))
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
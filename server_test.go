@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRequest 下载单个瓦片的任务请求
+func newTestRequest(t *testing.T, url, name string, output TaskOutput) TaskRequest {
+	t.Helper()
+	var req TaskRequest
+	body := `{"tm": {"name": "` + name + `", "min": 1, "max": 1, "format": "png", "url": "` + url + `/{z}/{x}/{y}.png"},
+		"lrs": [{"min": 1, "max": 1, "tiles": ["1/0/0"]}]}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	req.Output = output
+	return req
+}
+
+func TestSubmitOutputPath(t *testing.T) {
+	ts := httptest.NewServer(newTileServer())
+	defer ts.Close()
+	root := filepath.Join(t.TempDir(), "output")
+	setTestConfig(t, `
+[output]
+	format = "mbtiles"
+	directory = "`+filepath.ToSlash(root)+`"
+[server]
+	workers = 2
+`)
+	s := NewServer()
+	defer s.Abort()
+
+	rejected := []struct {
+		name   string
+		tname  string
+		output TaskOutput
+	}{
+		{"parent directory", "t", TaskOutput{Directory: filepath.Join(root, "..")}},
+		{"dot dot directory", "t", TaskOutput{Directory: root + "/../escape"}},
+		{"relative directory", "t", TaskOutput{Directory: "../escape"}},
+		{"file outside", "t", TaskOutput{File: filepath.Join(root, "..", "t.mbtiles")}},
+		{"file traversal", "t", TaskOutput{File: root + "/a/../../t.mbtiles"}},
+		{"file is the root", "t", TaskOutput{File: root, Format: "file"}},
+		{"name traversal", "../../t", TaskOutput{}},
+	}
+	for _, c := range rejected {
+		task, err := s.Submit(newTestRequest(t, ts.URL, c.tname, c.output))
+		if err == nil || !strings.Contains(err.Error(), "outside the output directory") {
+			t.Errorf("%s: submit = %v, %v, want outside the output directory", c.name, task, err)
+		}
+	}
+	if len(s.tasks) != 0 {
+		t.Fatalf("rejected tasks were started: %d", len(s.tasks))
+	}
+
+	//输出目录下的子目录允许
+	task, err := s.Submit(newTestRequest(t, ts.URL, "t", TaskOutput{Directory: filepath.Join(root, "sub")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir := filepath.Dir(task.File); dir != filepath.Join(root, "sub") {
+		t.Errorf("output dir = %s, want %s", dir, filepath.Join(root, "sub"))
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// loadShapefile 读取Shapefile要素, 属性来自同名.dbf, 坐标系来自.prj, 字符编码来自.cpg
+func loadShapefile(path string) ([]*geojson.Feature, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	geoms, err := readShp(data)
+	if err != nil {
+		return nil, fmt.Errorf("read %s error: %s", path, err)
+	}
+	var props []geojson.Properties
+	if dbf, err := os.ReadFile(sidecar(path, ".dbf")); err == nil {
+		cpg, _ := os.ReadFile(sidecar(path, ".cpg"))
+		props, err = readDbf(dbf, string(cpg))
+		if err != nil {
+			return nil, fmt.Errorf("read dbf of %s error: %s", path, err)
+		}
+		if len(props) != len(geoms) {
+			return nil, fmt.Errorf("%s has %d shapes but %d dbf records", path, len(geoms), len(props))
+		}
+	}
+	prj, _ := os.ReadFile(sidecar(path, ".prj"))
+	proj, err := prjProjection(string(prj))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	var features []*geojson.Feature
+	for i, g := range geoms {
+		if g == nil {
+			continue
+		}
+		f := geojson.NewFeature(g)
+		if props != nil {
+			if props[i] == nil { //已删除的记录
+				continue
+			}
+			f.Properties = props[i]
+		}
+		features = append(features, f)
+	}
+	return projectFeatures(features, proj), nil
+}
+
+// sidecar Shapefile的同名附属文件, 扩展名大小写均可
+func sidecar(path, ext string) string {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for _, e := range []string{ext, strings.ToUpper(ext)} {
+		if _, err := os.Stat(base + e); err == nil {
+			return base + e
+		}
+	}
+	return base + ext
+}
+
+// readShp 解析.shp中的几何, 空几何为nil, 只取x、y
+func readShp(data []byte) ([]orb.Geometry, error) {
+	if len(data) < 100 || binary.BigEndian.Uint32(data) != 9994 {
+		return nil, fmt.Errorf("not a shapefile")
+	}
+	var geoms []orb.Geometry
+	for off := 100; off+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[off+4:])) * 2
+		off += 8
+		if off+n > len(data) {
+			return nil, fmt.Errorf("record %d is truncated", len(geoms)+1)
+		}
+		g, err := shpGeometry(data[off : off+n])
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %s", len(geoms)+1, err)
+		}
+		geoms = append(geoms, g)
+		off += n
+	}
+	return geoms, nil
+}
+
+// shpGeometry 解析一条记录的几何, 支持点、多点、线、面及其Z、M类型
+func shpGeometry(b []byte) (orb.Geometry, error) {
+	if len(b) < 4 {
+		return nil, nil
+	}
+	le := binary.LittleEndian
+	point := func(i int) orb.Point {
+		return orb.Point{math.Float64frombits(le.Uint64(b[i:])), math.Float64frombits(le.Uint64(b[i+8:]))}
+	}
+	typ := le.Uint32(b)
+	switch typ {
+	case 0:
+		return nil, nil
+	case 1, 11, 21:
+		if len(b) < 20 {
+			return nil, fmt.Errorf("short point")
+		}
+		return point(4), nil
+	case 8, 18, 28:
+		if len(b) < 40 {
+			return nil, fmt.Errorf("short multipoint")
+		}
+		n := int(le.Uint32(b[36:]))
+		if len(b) < 40+16*n {
+			return nil, fmt.Errorf("short multipoint")
+		}
+		mp := make(orb.MultiPoint, n)
+		for i := range mp {
+			mp[i] = point(40 + 16*i)
+		}
+		return mp, nil
+	case 3, 13, 23, 5, 15, 25:
+		if len(b) < 44 {
+			return nil, fmt.Errorf("short shape")
+		}
+		parts, points := int(le.Uint32(b[36:])), int(le.Uint32(b[40:]))
+		start := 44 + 4*parts
+		if parts < 0 || points < 0 || len(b) < start+16*points {
+			return nil, fmt.Errorf("short shape")
+		}
+		lines := make([]orb.LineString, 0, parts)
+		for i := 0; i < parts; i++ {
+			s, e := int(le.Uint32(b[44+4*i:])), points
+			if i+1 < parts {
+				e = int(le.Uint32(b[48+4*i:]))
+			}
+			if s > e || e > points {
+				return nil, fmt.Errorf("invalid part %d", i)
+			}
+			ls := make(orb.LineString, e-s)
+			for j := range ls {
+				ls[j] = point(start + 16*(s+j))
+			}
+			lines = append(lines, ls)
+		}
+		if typ%10 == 3 {
+			if len(lines) == 1 {
+				return lines[0], nil
+			}
+			return orb.MultiLineString(lines), nil
+		}
+		return shpPolygon(lines), nil
+	}
+	return nil, fmt.Errorf("unsupported shape type %d", typ)
+}
+
+// shpPolygon 按环的方向组合面, 顺时针为外环, 逆时针为内环, 内环归入包含它的外环
+func shpPolygon(lines []orb.LineString) orb.Geometry {
+	var polygons orb.MultiPolygon
+	var holes []orb.Ring
+	for _, ls := range lines {
+		r := orb.Ring(ls)
+		if len(r) < 4 {
+			continue
+		}
+		if ringArea(r) <= 0 {
+			polygons = append(polygons, orb.Polygon{r})
+		} else {
+			holes = append(holes, r)
+		}
+	}
+	for _, h := range holes {
+		found := false
+		for i, p := range polygons {
+			if ringContains(p[0], h[0]) {
+				polygons[i] = append(polygons[i], h)
+				found = true
+				break
+			}
+		}
+		if !found { //方向不规范时作为外环
+			polygons = append(polygons, orb.Polygon{h})
+		}
+	}
+	switch len(polygons) {
+	case 0:
+		return nil
+	case 1:
+		return polygons[0]
+	}
+	return polygons
+}
+
+// readDbf 解析.dbf属性表, 已删除的记录为nil; 数值字段转为数值, 文本按cpg或编码标识解码, 未标明时UTF-8无效则按GBK解码
+func readDbf(data []byte, cpg string) ([]geojson.Properties, error) {
+	if len(data) < 32 {
+		return nil, fmt.Errorf("not a dbf file")
+	}
+	le := binary.LittleEndian
+	num, hlen, rlen := int(le.Uint32(data[4:])), int(le.Uint16(data[8:])), int(le.Uint16(data[10:]))
+	type field struct {
+		name string
+		typ  byte
+		size int
+	}
+	var fields []field
+	for off := 32; off+32 <= hlen && off+32 <= len(data) && data[off] != 0x0D; off += 32 {
+		name := strings.TrimRight(string(data[off:off+11]), "\x00 ")
+		fields = append(fields, field{name, data[off+11], int(data[off+16])})
+	}
+	cpg = strings.ToUpper(strings.TrimSpace(cpg))
+	gbk := strings.Contains(cpg, "GB") || strings.Contains(cpg, "936") || data[29] == 0x4D || data[29] == 0x7A
+	if strings.Contains(cpg, "UTF") {
+		gbk = false
+	}
+	decode := func(b []byte) string {
+		if !gbk && utf8.Valid(b) {
+			return string(b)
+		}
+		s, err := simplifiedchinese.GB18030.NewDecoder().Bytes(b)
+		if err != nil {
+			return string(b)
+		}
+		return string(s)
+	}
+	props := make([]geojson.Properties, 0, num)
+	for i := 0; i < num; i++ {
+		off := hlen + i*rlen
+		if off+rlen > len(data) {
+			return nil, fmt.Errorf("record %d is truncated", i+1)
+		}
+		rec := data[off : off+rlen]
+		if rec[0] == '*' {
+			props = append(props, nil)
+			continue
+		}
+		p := make(geojson.Properties, len(fields))
+		pos := 1
+		for _, f := range fields {
+			if pos+f.size > len(rec) {
+				break
+			}
+			raw := rec[pos : pos+f.size]
+			pos += f.size
+			s := strings.TrimSpace(strings.TrimRight(string(raw), "\x00"))
+			switch f.typ {
+			case 'N', 'F':
+				if v, err := strconv.ParseFloat(s, 64); err == nil {
+					p[f.name] = v
+				}
+			case 'L':
+				switch s {
+				case "T", "t", "Y", "y":
+					p[f.name] = true
+				case "F", "f", "N", "n":
+					p[f.name] = false
+				}
+			default:
+				if v := strings.TrimSpace(decode([]byte(s))); v != "" {
+					p[f.name] = v
+				}
+			}
+		}
+		props = append(props, p)
+	}
+	return props, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/project"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// shpRecord 按类型编码.shp记录内容, 点为[x, y], 线和面为各部分的点
+func shpRecord(typ uint32, parts ...[]orb.Point) []byte {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&b, le, typ)
+	switch typ {
+	case 1:
+		binary.Write(&b, le, parts[0][0])
+	case 3, 5:
+		binary.Write(&b, le, [4]float64{}) //范围不参与解析
+		n := 0
+		for _, p := range parts {
+			n += len(p)
+		}
+		binary.Write(&b, le, uint32(len(parts)))
+		binary.Write(&b, le, uint32(n))
+		start := 0
+		for _, p := range parts {
+			binary.Write(&b, le, uint32(start))
+			start += len(p)
+		}
+		for _, p := range parts {
+			for _, pt := range p {
+				binary.Write(&b, le, pt)
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// writeShp 写出.shp文件头及记录
+func writeShp(t *testing.T, file string, records ...[]byte) {
+	t.Helper()
+	var body bytes.Buffer
+	for i, r := range records {
+		binary.Write(&body, binary.BigEndian, [2]uint32{uint32(i + 1), uint32(len(r) / 2)})
+		body.Write(r)
+	}
+	head := make([]byte, 100)
+	binary.BigEndian.PutUint32(head, 9994)
+	binary.BigEndian.PutUint32(head[24:], uint32((100+body.Len())/2))
+	binary.LittleEndian.PutUint32(head[28:], 1000)
+	if err := os.WriteFile(file, append(head, body.Bytes()...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dbfField .dbf字段定义
+type dbfField struct {
+	name string
+	typ  byte
+	size int
+}
+
+// writeDbf 写出.dbf, ldid为语言驱动标识, 记录以*开头表示已删除
+func writeDbf(t *testing.T, file string, ldid byte, fields []dbfField, records [][]string) {
+	t.Helper()
+	rlen := 1
+	for _, f := range fields {
+		rlen += f.size
+	}
+	hlen := 32 + 32*len(fields) + 1
+	head := make([]byte, 32)
+	head[0] = 3
+	binary.LittleEndian.PutUint32(head[4:], uint32(len(records)))
+	binary.LittleEndian.PutUint16(head[8:], uint16(hlen))
+	binary.LittleEndian.PutUint16(head[10:], uint16(rlen))
+	head[29] = ldid
+	var b bytes.Buffer
+	b.Write(head)
+	for _, f := range fields {
+		desc := make([]byte, 32)
+		copy(desc, f.name)
+		desc[11] = f.typ
+		desc[16] = byte(f.size)
+		b.Write(desc)
+	}
+	b.WriteByte(0x0D)
+	for _, rec := range records {
+		flag := byte(' ')
+		if strings.HasPrefix(rec[0], "*") {
+			flag = '*'
+			rec = append([]string{strings.TrimPrefix(rec[0], "*")}, rec[1:]...)
+		}
+		b.WriteByte(flag)
+		for i, f := range fields {
+			v := []byte(rec[i])
+			if len(v) > f.size {
+				t.Fatalf("value %q longer than field %s", rec[i], f.name)
+			}
+			b.Write(v)
+			b.Write(bytes.Repeat([]byte{' '}, f.size-len(v)))
+		}
+	}
+	b.WriteByte(0x1A)
+	if err := os.WriteFile(file, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func gbk(t *testing.T, s string) string {
+	t.Helper()
+	b, err := simplifiedchinese.GBK.NewEncoder().String(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLoadShapefile(t *testing.T) {
+	dir := t.TempDir()
+	outer := []orb.Point{{118, 31}, {118, 33}, {120, 33}, {120, 31}, {118, 31}} //顺时针外环
+	hole := []orb.Point{{118.5, 31.5}, {119.5, 31.5}, {119.5, 32.5}, {118.5, 32.5}, {118.5, 31.5}}
+	shp := filepath.Join(dir, "regions.shp")
+	writeShp(t, shp,
+		shpRecord(5, outer, hole),
+		shpRecord(3, []orb.Point{{118, 31}, {119, 32}}, []orb.Point{{119, 32}, {120, 33}}),
+		shpRecord(1, []orb.Point{{118.8, 32.1}}),
+		shpRecord(0),
+		shpRecord(1, []orb.Point{{100, 30}}),
+	)
+	fields := []dbfField{{"NAME", 'C', 20}, {"ADCODE", 'N', 10}, {"CAPITAL", 'L', 1}}
+	records := [][]string{
+		{gbk(t, "江苏省"), "320000", "F"},
+		{gbk(t, "长江"), "", "?"},
+		{gbk(t, "南京市"), "320100", "T"},
+		{"", "0", "F"},
+		{"*" + gbk(t, "已删除"), "1", "F"},
+	}
+
+	//GBK按.dbf语言驱动标识、.cpg及UTF-8校验识别
+	for _, c := range []struct {
+		name string
+		ldid byte
+		cpg  string
+	}{
+		{"ldid", 0x4D, ""},
+		{"cpg", 0, "GBK"},
+		{"invalid utf-8", 0, ""},
+	} {
+		writeDbf(t, filepath.Join(dir, "regions.dbf"), c.ldid, fields, records)
+		os.Remove(filepath.Join(dir, "regions.cpg"))
+		if c.cpg != "" {
+			os.WriteFile(filepath.Join(dir, "regions.cpg"), []byte(c.cpg), 0644)
+		}
+		features, err := loadShapefile(shp)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		//空几何及已删除的记录跳过
+		if len(features) != 3 {
+			t.Fatalf("%s: features = %d, want 3", c.name, len(features))
+		}
+		names := []string{"江苏省", "长江", "南京市"}
+		for i, f := range features {
+			if f.Properties["NAME"] != names[i] {
+				t.Errorf("%s: name %d = %q, want %q", c.name, i, f.Properties["NAME"], names[i])
+			}
+		}
+		p := features[0].Properties
+		if p["ADCODE"] != 320000.0 || p["CAPITAL"] != false {
+			t.Errorf("%s: properties = %v", c.name, p)
+		}
+		if _, ok := features[1].Properties["ADCODE"]; ok {
+			t.Errorf("%s: empty number kept: %v", c.name, features[1].Properties)
+		}
+		if features[2].Properties["CAPITAL"] != true {
+			t.Errorf("%s: logical = %v", c.name, features[2].Properties)
+		}
+	}
+
+	features, err := loadShapefile(shp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []orb.Geometry{
+		orb.Polygon{outer, hole},
+		orb.MultiLineString{{{118, 31}, {119, 32}}, {{119, 32}, {120, 33}}},
+		orb.Point{118.8, 32.1},
+	}
+	for i, g := range want {
+		if !orb.Equal(features[i].Geometry, g) {
+			t.Errorf("geometry %d = %v, want %v", i, features[i].Geometry, g)
+		}
+	}
+
+	c, err := loadRegion(shp, "", "NAME LIKE '南京%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 1 || c[0] != (orb.Point{118.8, 32.1}) {
+		t.Errorf("region = %v, want the point of 南京市", c)
+	}
+
+	//记录数与属性表不一致
+	writeDbf(t, filepath.Join(dir, "regions.dbf"), 0, fields, records[:2])
+	if _, err := loadShapefile(shp); err == nil || !strings.Contains(err.Error(), "dbf records") {
+		t.Errorf("mismatched dbf: %v", err)
+	}
+}
+
+func TestLoadShapefileMercator(t *testing.T) {
+	dir := t.TempDir()
+	shp := filepath.Join(dir, "point.SHP")
+	p := project.WGS84.ToMercator(orb.Point{118.8, 32.1})
+	writeShp(t, shp, shpRecord(1, []orb.Point{p}))
+	prj := `PROJCS["WGS_1984_Web_Mercator_Auxiliary_Sphere",GEOGCS["GCS_WGS_1984"]]`
+	os.WriteFile(filepath.Join(dir, "point.PRJ"), []byte(prj), 0644)
+	features, err := loadShapefile(shp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, ok := features[0].Geometry.(orb.Point)
+	if !ok || math.Abs(g[0]-118.8) > 1e-9 || math.Abs(g[1]-32.1) > 1e-9 {
+		t.Errorf("point = %v, want 118.8,32.1", features[0].Geometry)
+	}
+
+	//不支持的投影坐标系
+	os.WriteFile(filepath.Join(dir, "point.PRJ"), []byte(`PROJCS["CGCS2000_3_Degree_GK_CM_117E"]`), 0644)
+	if _, err := loadShapefile(shp); err == nil || !strings.Contains(err.Error(), "unsupported coordinate system") {
+		t.Errorf("gauss kruger: %v, want unsupported coordinate system", err)
+	}
+}
+
+func TestReadShpErrors(t *testing.T) {
+	var head [100]byte
+	binary.BigEndian.PutUint32(head[:], 9994)
+	cases := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"not shapefile", make([]byte, 100), "not a shapefile"},
+		{"truncated record", append(head[:], 0, 0, 0, 1, 0, 0, 0, 10), "truncated"},
+		{"huge multipoint", append(append(head[:], 0, 0, 0, 1, 0, 0, 0, 20), func() []byte {
+			b := make([]byte, 40)
+			binary.LittleEndian.PutUint32(b, 8)
+			binary.LittleEndian.PutUint32(b[36:], 0xffffffff)
+			return b
+		}()...), "short multipoint"},
+		{"unsupported", append(append(head[:], 0, 0, 0, 1, 0, 0, 0, 2), 31, 0, 0, 0), "unsupported shape type 31"},
+	}
+	for _, c := range cases {
+		_, err := readShp(c.data)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultUserAgent 默认请求UA
+const DefaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// Source 瓦片源请求配置, 同一来源共享一个http.Client
+type Source struct {
+	Headers  map[string]string
+	Cookie   string
+	Proxy    string //支持http/https/socks5代理
+	Insecure *bool  //跳过TLS证书校验, 未设置时继承, 设为false可重新开启校验
+	Timeout  int    //请求超时, 单位毫秒
+	client   *http.Client
+}
+
+// Empty 是否未做任何配置
+func (src *Source) Empty() bool {
+	return len(src.Headers) == 0 && src.Cookie == "" && src.Proxy == "" && src.Insecure == nil && src.Timeout == 0
+}
+
+// Inherit 未设置的项继承自base, 请求头逐项合并
+func (src *Source) Inherit(base *Source) {
+	headers := make(map[string]string)
+	for k, v := range base.Headers {
+		headers[k] = v
+	}
+	for k, v := range src.Headers {
+		headers[k] = v
+	}
+	src.Headers = headers
+	if src.Cookie == "" {
+		src.Cookie = base.Cookie
+	}
+	if src.Proxy == "" {
+		src.Proxy = base.Proxy
+	}
+	if src.Timeout == 0 {
+		src.Timeout = base.Timeout
+	}
+	if src.Insecure == nil {
+		src.Insecure = base.Insecure
+	}
+}
+
+// Setup 创建该来源的http.Client, 需在并发请求前调用
+func (src *Source) Setup() error {
+	if src.client != nil {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 64
+	if src.Proxy != "" {
+		proxy, err := url.Parse(src.Proxy)
+		if err != nil {
+			return err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if src.Insecure != nil && *src.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	src.client = &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(src.Timeout) * time.Millisecond,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// 自定义重定向的行为
+			return http.ErrUseLastResponse // 使用最后一个响应
+		},
+	}
+	return nil
+}
+
+// Do 发送请求
+func (src *Source) Do(req *http.Request) (*http.Response, error) {
+	return src.client.Do(req)
+}
+
+// NewRequest 创建带有该来源请求头及cookie的请求
+func (src *Source) NewRequest(tile string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", tile, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", DefaultUserAgent)
+	for k, v := range src.Headers {
+		req.Header.Set(k, v)
+	}
+	if src.Cookie != "" {
+		req.Header.Set("Cookie", src.Cookie)
+	}
+	return req, nil
+}
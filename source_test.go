@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSourceInheritInsecure(t *testing.T) {
+	yes, no := true, false
+	cases := []struct {
+		name       string
+		layer      *bool
+		base       *bool
+		want, skip bool
+	}{
+		{"unset inherits insecure", nil, &yes, true, true},
+		{"unset inherits secure", nil, &no, false, false},
+		{"unset base unset", nil, nil, false, false},
+		{"false overrides insecure", &no, &yes, false, false},
+		{"true overrides secure", &yes, &no, true, true},
+	}
+	for _, c := range cases {
+		src := Source{Insecure: c.layer}
+		src.Inherit(&Source{Insecure: c.base})
+		got := src.Insecure != nil && *src.Insecure
+		if got != c.want {
+			t.Errorf("%s: insecure = %v, want %v", c.name, got, c.want)
+		}
+		if err := src.Setup(); err != nil {
+			t.Fatal(err)
+		}
+		tls := src.client.Transport.(*http.Transport).TLSClientConfig
+		if skip := tls != nil && tls.InsecureSkipVerify; skip != c.skip {
+			t.Errorf("%s: skip verify = %v, want %v", c.name, skip, c.skip)
+		}
+	}
+}
+
+func TestSourceEmptyExplicitFalse(t *testing.T) {
+	no := false
+	if (&Source{Insecure: &no}).Empty() {
+		t.Error("source with insecure = false is not empty, it overrides tm")
+	}
+	if !(&Source{}).Empty() {
+		t.Error("zero source should be empty")
+	}
+}
+
+func TestSourceInsecureConfig(t *testing.T) {
+	setTestConfig(t, `
+[[lrs]]
+	min = 1
+	insecure = false
+[[lrs]]
+	min = 2
+`)
+	var lrs []struct {
+		Min      int
+		Insecure *bool
+	}
+	if err := viper.UnmarshalKey("lrs", &lrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(lrs) != 2 || lrs[0].Insecure == nil || *lrs[0].Insecure || lrs[1].Insecure != nil {
+		t.Errorf("decoded insecure = %+v, want explicit false then unset", lrs)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrTileNotFound 存储中无该瓦片
+var ErrTileNotFound = errors.New("tile not found")
+
+// TileStore 瓦片存储, 新的输出格式实现该接口即可, 无需改动下载流程
+// Put、Has、Get需支持并发调用
+type TileStore interface {
+	Open() error
+	Put(tile Tile) error
+	Has(t maptile.Tile) (bool, error)
+	Get(t maptile.Tile) ([]byte, error)
+	WriteMetadata(meta map[string]string) error
+	Close() error
+}
+
+// BatchStore 支持事务批量写入的存储, 瓦片经保存管道攒批后写入
+// 返回写入失败的瓦片及错误, 其余瓦片视为已保存
+type BatchStore interface {
+	TileStore
+	PutBatch(tiles []Tile) map[maptile.Tile]error
+}
+
+// storeExts 输出格式对应的文件扩展名
+var storeExts = map[string]string{
+	"mbtiles": ".mbtiles",
+	"gpkg":    ".gpkg",
+	"pmtiles": ".pmtiles",
+}
+
+// Output modes
+const (
+	ModeOverwrite = "overwrite" //删除已有输出后重新下载
+	ModeSkip      = "skip"      //保留已有输出, 跳过已存在的瓦片
+	ModeUpdate    = "update"    //保留已有输出, 重新下载并替换已存在的瓦片
+)
+
+// outputFile 确定输出路径
+// 指定output.file时输出到该路径, skip/update模式下输出到固定路径{name}.{format}, 否则按任务命名
+func (task *Task) outputFile() (string, error) {
+	switch task.mode {
+	case ModeOverwrite, ModeSkip, ModeUpdate:
+	default:
+		return "", fmt.Errorf("unknown output mode %q", task.mode)
+	}
+	//PMTiles归档不保存校验信息, 无法按条件请求更新
+	if task.mode == ModeUpdate && task.outformat == "pmtiles" {
+		return "", fmt.Errorf("output mode update is not supported by pmtiles")
+	}
+	if task.File != "" {
+		return task.File, nil
+	}
+	if task.outfile != "" {
+		return task.outfile, nil
+	}
+	name := fmt.Sprintf("%s-z%d-%d.%s%s", task.Name, task.Min, task.Max, task.ID, storeExts[task.outformat])
+	if task.mode != ModeOverwrite {
+		name = task.Name + storeExts[task.outformat]
+	}
+	return filepath.Join(task.outdir, name), nil
+}
+
+// newTileStore 按输出格式创建存储
+func (task *Task) newTileStore() (TileStore, error) {
+	file, err := task.outputFile()
+	if err != nil {
+		return nil, err
+	}
+	if task.File == "" {
+		task.File = file
+	}
+	os.MkdirAll(filepath.Dir(task.File), os.ModePerm)
+	keep := task.resume || task.mode != ModeOverwrite
+	update := task.mode == ModeUpdate
+	switch task.outformat {
+	case "mbtiles":
+		return &MBTileStore{File: task.File, Dedupe: task.dedupe, Keep: keep, Update: update}, nil
+	case "gpkg":
+		return &GPKGStore{File: task.File, Table: gpkgTable(task.Name), Keep: keep, Update: update}, nil
+	case "pmtiles":
+		return &PMTilesStore{File: task.File, Keep: keep}, nil
+	case "s3":
+		//task.File为本地账本及失败列表路径
+		s3 := NewS3Store(task.format, task.outschema == "tms", keep)
+		s3.Ctx = task.ctx
+		return s3, nil
+	}
+	return &FileStore{Dir: task.File, Format: task.format, TMS: task.outschema == "tms", Keep: keep, Update: update}, nil
+}
+
+// FileStore 文件目录存储, 按z/x/y.format组织
+type FileStore struct {
+	Dir    string
+	Format string
+	TMS    bool //按TMS行号命名文件
+	Keep   bool //合并已有元数据
+	Update bool //update模式, 校验信息保存在目录旁的{Dir}.etag索引中
+
+	db        *sql.DB
+	validStmt *sql.Stmt
+}
+
+// Open 创建输出目录, update模式下打开校验信息索引
+func (fs *FileStore) Open() error {
+	err := os.MkdirAll(fs.Dir, os.ModePerm)
+	if err != nil || !fs.Update {
+		return err
+	}
+	//索引放在瓦片目录外, 不混入发布的瓦片
+	db, err := sql.Open("sqlite3", fs.indexFile()+"?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1)
+	err = setupValidatorTable(db)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	fs.validStmt, err = prepareValidator(db)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	fs.db = db
+	return nil
+}
+
+func (fs *FileStore) indexFile() string {
+	return filepath.Clean(fs.Dir) + ".etag"
+}
+
+func (fs *FileStore) path(t maptile.Tile) string {
+	y := t.Y
+	if fs.TMS {
+		y = Tile{T: t}.flipY()
+	}
+	return filepath.Join(fs.Dir, strconv.Itoa(int(t.Z)), strconv.Itoa(int(t.X)), fmt.Sprintf(`%d.%s`, y, fs.Format))
+}
+
+// Put 写入瓦片文件, 有校验信息时写入索引
+func (fs *FileStore) Put(tile Tile) error {
+	fileName := fs.path(tile.T)
+	os.MkdirAll(filepath.Dir(fileName), os.ModePerm)
+	err := os.WriteFile(fileName, tile.C, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	if fs.validStmt != nil {
+		err = saveValidator(fs.validStmt, tile.T.Z, tile.T.X, tile.T.Y, tile.V)
+		if err != nil {
+			return err
+		}
+	}
+	log.Println(fileName)
+	return nil
+}
+
+// Validator 从索引读取瓦片校验信息
+func (fs *FileStore) Validator(t maptile.Tile) (Validator, error) {
+	if fs.db == nil {
+		return Validator{}, nil
+	}
+	return queryValidator(fs.db, t.Z, t.X, t.Y)
+}
+
+// Has 瓦片文件是否存在
+func (fs *FileStore) Has(t maptile.Tile) (bool, error) {
+	_, err := os.Stat(fs.path(t))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Get 读取瓦片文件
+func (fs *FileStore) Get(t maptile.Tile) ([]byte, error) {
+	data, err := os.ReadFile(fs.path(t))
+	if os.IsNotExist(err) {
+		return nil, ErrTileNotFound
+	}
+	return data, err
+}
+
+// WriteMetadata 元数据写入目录下的metadata.json
+func (fs *FileStore) WriteMetadata(meta map[string]string) error {
+	file := filepath.Join(fs.Dir, "metadata.json")
+	if fs.Keep {
+		var old map[string]string
+		data, err := os.ReadFile(file)
+		if err == nil && json.Unmarshal(data, &old) == nil {
+			meta = mergeMeta(old, meta)
+		}
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(meta)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Close 关闭校验信息索引
+func (fs *FileStore) Close() error {
+	if fs.db == nil {
+		return nil
+	}
+	fs.validStmt.Close()
+	return fs.db.Close()
+}
+
+// mergeMeta 保留已有输出时合并元数据, 范围取并集, 级别取两者的最大范围
+func mergeMeta(old, meta map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for k, v := range meta {
+		merged[k] = v
+	}
+	if b := metaBound(old); !b.IsEmpty() {
+		b = unionBound(metaBound(meta), b)
+		merged["bounds"] = fmt.Sprintf(`%f,%f,%f,%f`, b.Left(), b.Bottom(), b.Right(), b.Top())
+	}
+	if _, ok := old["minzoom"]; ok {
+		min, max := metaZoom(meta)
+		omin, omax := metaZoom(old)
+		if omin < min {
+			merged["minzoom"] = strconv.Itoa(omin)
+		}
+		if omax > max {
+			merged["maxzoom"] = strconv.Itoa(omax)
+		}
+	}
+	return merged
+}
+
+// metaBound 解析元数据中的bounds项
+func metaBound(meta map[string]string) orb.Bound {
+	var l, b, r, t float64
+	_, err := fmt.Sscanf(meta["bounds"], "%f,%f,%f,%f", &l, &b, &r, &t)
+	if err != nil {
+		return orb.Bound{Min: orb.Point{1, 1}, Max: orb.Point{-1, -1}}
+	}
+	return orb.Bound{Min: orb.Point{l, b}, Max: orb.Point{r, t}}
+}
+
+// metaCenter 解析元数据中的center项
+func metaCenter(meta map[string]string) orb.Point {
+	var x, y float64
+	fmt.Sscanf(meta["center"], "%f,%f", &x, &y)
+	return orb.Point{x, y}
+}
+
+// metaZoom 解析元数据中的级别范围
+func metaZoom(meta map[string]string) (min, max int) {
+	min, _ = strconv.Atoi(strings.TrimSpace(meta["minzoom"]))
+	max, _ = strconv.Atoi(strings.TrimSpace(meta["maxzoom"]))
+	return min, max
+}
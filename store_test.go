@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// sqliteStore 保存校验信息的sqlite存储
+type sqliteStore interface {
+	TileStore
+	ValidatorStore
+}
+
+func TestSQLiteStoreValidators(t *testing.T) {
+	dir := t.TempDir()
+	stores := []struct {
+		name  string
+		store func(update bool) sqliteStore
+	}{
+		{"mbtiles", func(update bool) sqliteStore {
+			return &MBTileStore{File: filepath.Join(dir, "t.mbtiles"), Keep: true, Update: update}
+		}},
+		{"mbtiles dedupe", func(update bool) sqliteStore {
+			return &MBTileStore{File: filepath.Join(dir, "d.mbtiles"), Dedupe: true, Keep: true, Update: update}
+		}},
+		{"gpkg", func(update bool) sqliteStore {
+			return &GPKGStore{File: filepath.Join(dir, "t.gpkg"), Table: "t", Keep: true, Update: update}
+		}},
+	}
+	v := Validator{ETag: `"abc"`, LastModified: "Wed, 21 Oct 2015 07:28:00 GMT", Hash: "h"}
+	tile := Tile{T: maptile.New(1, 0, 1), C: []byte("png"), V: v}
+	for _, c := range stores {
+		//overwrite、skip模式不在输出中添加tile_validators表
+		s := c.store(false)
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put(tile); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got, err := s.Validator(tile.T); err != nil || !got.Empty() {
+			t.Errorf("%s: validator without update = %+v, %v, want empty", c.name, got, err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if hasValidatorTable(t, c.store(false)) {
+			t.Errorf("%s: tile_validators table created outside update mode", c.name)
+		}
+
+		//update模式保存并读回校验信息
+		s = c.store(true)
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put(tile); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got, err := s.Validator(tile.T); err != nil || got != v {
+			t.Errorf("%s: validator in update mode = %+v, %v, want %+v", c.name, got, err, v)
+		}
+		if data, err := s.Get(tile.T); err != nil || string(data) != "png" {
+			t.Errorf("%s: tile = %q, %v", c.name, data, err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !hasValidatorTable(t, c.store(true)) {
+			t.Errorf("%s: tile_validators table missing in update mode", c.name)
+		}
+	}
+}
+
+func hasValidatorTable(t *testing.T, s sqliteStore) bool {
+	t.Helper()
+	var file string
+	switch s := s.(type) {
+	case *MBTileStore:
+		file = s.File
+	case *GPKGStore:
+		file = s.File
+	}
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	err = db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = 'tile_validators';").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
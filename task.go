@@ -3,16 +3,14 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
-	"database/sql"
+	"context"
 	"fmt"
 	"io"
-	"math"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/paulmach/orb"
@@ -27,36 +25,71 @@ import (
 // MBTileVersion mbtiles版本号
 const MBTileVersion = "1.2"
 
+// Constants representing task states
+const (
+	TaskWaiting int32 = iota
+	TaskRunning
+	TaskPaused
+	TaskAborted
+	TaskFinished
+	TaskFailed
+)
+
+var taskStates = []string{"waiting", "running", "paused", "aborted", "finished", "failed"}
+
 // Task 下载任务
 type Task struct {
-	ID                 string
-	Name               string
-	Description        string
-	File               string
-	Min                int
-	Max                int
-	Layers             []Layer
-	TileMap            TileMap
-	Total              int64
-	Current            int64
-	Bar                *pb.ProgressBar
-	db                 *sql.DB
-	workerCount        int
-	savePipeSize       int
-	timeDelay          int
-	bufSize            int
-	tileWG             sync.WaitGroup
-	abort, pause, play chan struct{}
-	workers            chan maptile.Tile
-	savingpipe         chan Tile
-	tileSet            Set
-	outformat          string
+	ID            string
+	Name          string
+	Description   string
+	File          string
+	Min           int
+	Max           int
+	Layers        []Layer
+	TileMap       TileMap
+	Total         int64
+	Current       int64
+	Bar           *pb.ProgressBar
+	store         TileStore
+	workerCount   int
+	savePipeSize  int
+	batchSize     int
+	flushInterval time.Duration
+	timeDelay     int
+	bufSize       int
+	tileWG        sync.WaitGroup
+	saveWG        sync.WaitGroup
+	pause, play   chan struct{}
+	ctx           context.Context
+	cancel        context.CancelFunc
+	workers       chan maptile.Tile
+	savingpipe    chan Tile
+	tileSet       Set
+	outformat     string
+	outschema     string
+	outdir        string
+	outfile       string //固定输出路径
+	dedupe        bool
+	resume        bool
+	mode          string
+	skipped       int64 //skip模式下已存在而跳过的瓦片数
+	unchanged     int64 //update模式下源站未变化的瓦片数
+	blank         *BlankFilter
+	encoder       *RasterEncoder
+	mask          *TileMask
+	vector        *VectorProcessor
+	format        string //输出瓦片格式, 重新编码时与源格式不同
+	blankSet      Set    //识别为空白的瓦片集
+	ledger        *Ledger
+	retry         RetryPolicy
+	limiter       *RateLimiter
+	state         int32
 }
 
-// NewTask 创建下载任务
-func NewTask(layers []Layer, m TileMap) *Task {
+// NewTask 创建下载任务, 没有图层或请求参数无效时返回错误
+func NewTask(layers []Layer, m TileMap) (*Task, error) {
 	if len(layers) == 0 {
-		return nil
+		return nil, fmt.Errorf("no layers to download")
 	}
 	id, _ := shortid.Generate()
 
@@ -73,33 +106,84 @@ func NewTask(layers []Layer, m TileMap) *Task {
 		if layers[i].URL == "" {
 			layers[i].URL = m.URL
 		}
-		layers[i].Count = tilecover.CollectionCount(layers[i].Collection, maptile.Zoom(layers[i].Zoom))
+		if len(layers[i].Subdomains) == 0 {
+			layers[i].Subdomains = m.Subdomains
+		}
+		if layers[i].Balance == "" {
+			layers[i].Balance = m.Balance
+		}
+		if layers[i].MatrixPrefix == "" {
+			layers[i].MatrixPrefix = m.MatrixPrefix
+		}
+		if layers[i].Schema == "" {
+			layers[i].Schema = m.Schema
+		}
+		if layers[i].Source == nil {
+			layers[i].Source = &task.TileMap.Source
+		}
+		err := layers[i].Source.Setup()
+		if err != nil {
+			return nil, fmt.Errorf("setup source of zoom %d error: %s", layers[i].Zoom, err)
+		}
+		if layers[i].Tiles != nil {
+			layers[i].Count = int64(len(layers[i].Tiles))
+		} else if layers[i].Ranges != nil {
+			layers[i].Count = rangeCount(layers[i].Ranges)
+		} else {
+			layers[i].Count = tilecover.CollectionCount(layers[i].Collection, maptile.Zoom(layers[i].Zoom))
+		}
+		//外扩或简化的层级在下载时计算覆盖范围, 此前按原范围估算
 		log.Printf("zoom: %d, tiles: %d \n", layers[i].Zoom, layers[i].Count)
 		task.Total += layers[i].Count
 	}
-	task.abort = make(chan struct{})
-	task.pause = make(chan struct{})
-	task.play = make(chan struct{})
+	task.ctx, task.cancel = context.WithCancel(context.Background())
+	task.pause = make(chan struct{}, 1)
+	task.play = make(chan struct{}, 1)
 
 	task.workerCount = viper.GetInt("task.workers")
 	task.savePipeSize = viper.GetInt("task.savepipe")
 	task.timeDelay = viper.GetInt("task.timedelay")
 	task.workers = make(chan maptile.Tile, task.workerCount)
-	task.savingpipe = make(chan Tile, task.savePipeSize)
+	task.savingpipe = make(chan Tile, task.workerCount)
+	task.batchSize = viper.GetInt("output.batchsize")
+	task.flushInterval = time.Duration(viper.GetInt("output.flushinterval")) * time.Millisecond
+	if task.savePipeSize < 1 {
+		task.savePipeSize = 1
+	}
+	if task.batchSize < 1 {
+		task.batchSize = 1
+	}
+	if task.flushInterval <= 0 {
+		task.flushInterval = time.Second
+	}
 	task.bufSize = viper.GetInt("task.mergebuf")
-	task.tileSet = Set{M: make(maptile.Set)}
+	task.tileSet = Set{M: make(maptile.Set)} //失败瓦片集
+	task.blankSet = Set{M: make(maptile.Set)}
+	task.blank = NewBlankFilter()
+	task.encoder = NewRasterEncoder(m.Format)
+	task.format = m.Format
+	if task.encoder != nil {
+		task.format = task.encoder.Format
+	}
+	task.mask = NewTileMask(m.Format, task.encoder)
+	task.vector = NewVectorProcessor(m.Format)
+	task.retry = NewRetryPolicy()
+	task.limiter = NewRateLimiter()
 
 	task.outformat = viper.GetString("output.format")
-	return &task
+	task.outschema = viper.GetString("output.schema")
+	task.outdir = viper.GetString("output.directory")
+	task.outfile = viper.GetString("output.file")
+	task.dedupe = viper.GetBool("output.dedupe")
+	task.mode = viper.GetString("output.mode")
+	return &task, nil
 }
 
 // Bound 范围
 func (task *Task) Bound() orb.Bound {
 	bound := orb.Bound{Min: orb.Point{1, 1}, Max: orb.Point{-1, -1}}
 	for _, layer := range task.Layers {
-		for _, g := range layer.Collection {
-			bound = bound.Union(g.Bound())
-		}
+		bound = unionBound(bound, layer.Collection.Bound())
 	}
 	return bound
 }
@@ -107,11 +191,15 @@ func (task *Task) Bound() orb.Bound {
 // Center 中心点
 func (task *Task) Center() orb.Point {
 	layer := task.Layers[len(task.Layers)-1]
-	bound := orb.Bound{Min: orb.Point{1, 1}, Max: orb.Point{-1, -1}}
-	for _, g := range layer.Collection {
-		bound = bound.Union(g.Bound())
+	return layer.Collection.Bound().Center()
+}
+
+// unionBound 合并范围, 空范围不参与合并
+func unionBound(b, other orb.Bound) orb.Bound {
+	if b.IsEmpty() {
+		return other
 	}
-	return bound.Center()
+	return b.Union(other)
 }
 
 // MetaItems 输出
@@ -124,7 +212,7 @@ func (task *Task) MetaItems() map[string]string {
 		"description": task.Description,
 		"attribution": `<a href="http://www.atlasdata.cn/" target="_blank">&copy; MapCloud</a>`,
 		"basename":    task.TileMap.Name,
-		"format":      task.TileMap.Format,
+		"format":      task.format,
 		"type":        task.TileMap.Schema,
 		"pixel_scale": strconv.Itoa(TileSize),
 		"version":     MBTileVersion,
@@ -137,166 +225,297 @@ func (task *Task) MetaItems() map[string]string {
 	return data
 }
 
-// SetupMBTileTables 初始化配置MBTile库
-func (task *Task) SetupMBTileTables() error {
-
-	if task.File == "" {
-		outdir := viper.GetString("output.directory")
-		os.MkdirAll(outdir, os.ModePerm)
-		task.File = filepath.Join(outdir, fmt.Sprintf("%s-z%d-%d.%s.mbtiles", task.Name, task.Min, task.Max, task.ID))
-	}
-	os.Remove(task.File)
-	db, err := sql.Open("sqlite3", task.File)
-	if err != nil {
-		return err
-	}
-
-	err = optimizeConnection(db)
+// setupStore 创建并打开输出存储, 写入元数据
+func (task *Task) setupStore() error {
+	store, err := task.newTileStore()
 	if err != nil {
 		return err
 	}
-
-	_, err = db.Exec("create table if not exists tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);")
+	err = store.Open()
 	if err != nil {
 		return err
 	}
-
-	_, err = db.Exec("create table if not exists metadata (name text, value text);")
+	err = store.WriteMetadata(task.MetaItems())
 	if err != nil {
+		store.Close()
 		return err
 	}
+	task.store = store
+	return nil
+}
 
-	_, err = db.Exec("create unique index name on metadata (name);")
-	if err != nil {
-		return err
+// setupLedger 打开任务账本, 续传时读取已完成的瓦片数
+func (task *Task) setupLedger() error {
+	ledgerFile := task.File + ".ledger"
+	if !task.resume {
+		os.Remove(ledgerFile)
 	}
-
-	_, err = db.Exec("create unique index tile_index on tiles(zoom_level, tile_column, tile_row);")
+	ledger, err := OpenLedger(ledgerFile)
 	if err != nil {
 		return err
 	}
-
-	// Load metadata.
-	for name, value := range task.MetaItems() {
-		_, err := db.Exec("insert into metadata (name, value) values (?, ?)", name, value)
+	if task.resume {
+		info, err := ledger.Count()
 		if err != nil {
+			ledger.Close()
 			return err
 		}
+		log.Infof("resume task %s, done: %d, pending: %d, failed: %d ~", task.ID, info[TileDone], info[TilePending], info[TileFailed])
 	}
-
-	task.db = db //保存任务的库连接
+	task.ledger = ledger
 	return nil
 }
 
+// abortFun 取消任务, 停止派发瓦片, 已派发的瓦片保存后结束
 func (task *Task) abortFun() {
-	// os.Stdin.Read(make([]byte, 1)) // read a single byte
-	// <-time.After(8 * time.Second)
-	task.abort <- struct{}{}
+	task.cancel()
 }
 
+// pauseFun 暂停任务, 不阻塞调用方
 func (task *Task) pauseFun() {
-	// os.Stdin.Read(make([]byte, 1)) // read a single byte
-	// <-time.After(3 * time.Second)
-	task.pause <- struct{}{}
+	select {
+	case task.pause <- struct{}{}:
+	default:
+	}
 }
 
+// playFun 继续任务, 不阻塞调用方
 func (task *Task) playFun() {
-	// os.Stdin.Read(make([]byte, 1)) // read a single byte
-	// <-time.After(5 * time.Second)
-	task.play <- struct{}{}
+	select {
+	case task.play <- struct{}{}:
+	default:
+	}
 }
 
-// SavePipe 保存瓦片管道
+// State 任务状态
+func (task *Task) State() string {
+	return taskStates[atomic.LoadInt32(&task.state)]
+}
+
+// Aborted 任务是否已取消
+func (task *Task) Aborted() bool {
+	return task.ctx.Err() != nil
+}
+
+// SavePipe 保存瓦片管道, 满批次或定时在一个事务中提交
 func (task *Task) savePipe() {
-	for tile := range task.savingpipe {
-		err := saveToMBTile(tile, task.db)
-		if err != nil {
-			if strings.HasPrefix(err.Error(), "UNIQUE constraint failed") {
-				log.Warnf("save %v tile to mbtiles db error ~ %s", tile.T, err)
-			} else {
-				log.Errorf("save %v tile to mbtiles db error ~ %s", tile.T, err)
+	defer task.saveWG.Done()
+	batch := make([]Tile, 0, task.batchSize)
+	ticker := time.NewTicker(task.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case tile, ok := <-task.savingpipe:
+			if !ok {
+				task.flushTiles(batch)
+				return
 			}
+			batch = append(batch, tile)
+			if len(batch) >= task.batchSize {
+				task.flushTiles(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			task.flushTiles(batch)
+			batch = batch[:0]
 		}
 	}
 }
 
+// flushTiles 事务批量写入瓦片, 提交后更新账本
+func (task *Task) flushTiles(batch []Tile) {
+	if len(batch) == 0 {
+		return
+	}
+	errs := task.store.(BatchStore).PutBatch(batch)
+	for _, tile := range batch {
+		if err, ok := errs[tile.T]; ok {
+			log.Errorf("save %v tile to %s error ~ %s", tile.T, task.File, err)
+			task.failTile(tile.T)
+			continue
+		}
+		task.ledger.Record(tile.T, TileDone)
+	}
+}
+
 // SaveTile 保存瓦片
 func (task *Task) saveTile(tile Tile) error {
 	// defer task.wg.Done()
-	err := saveToFiles(tile, task)
+	err := task.store.Put(tile)
 	if err != nil {
-		log.Errorf("create %v tile file error ~ %s", tile.T, err)
+		log.Errorf("save %v tile to %s error ~ %s", tile.T, task.File, err)
+		task.failTile(tile.T)
+		return err
 	}
+	task.ledger.Record(tile.T, TileDone)
 	return nil
 }
 
+// fetchTile 请求瓦片数据, 有校验信息时发送条件请求, 源站返回304时返回ErrNotModified
+// 内容与瓦片格式不符时返回ContentError, 按失败重试
+func (task *Task) fetchTile(src *Source, tile string, v Validator) ([]byte, Validator, error) {
+	req, err := src.NewRequest(tile)
+	if err != nil {
+		return nil, Validator{}, err
+	}
+	v.SetConditional(req)
+	resp, err := src.Do(req)
+	if err != nil {
+		return nil, Validator{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, v, ErrNotModified
+	}
+	if resp.StatusCode != 200 {
+		io.Copy(io.Discard, resp.Body)
+		return nil, Validator{}, &StatusError{Code: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, Validator{}, err
+	}
+	err = checkContent(task.TileMap.Format, resp.Header.Get("Content-Type"), body)
+	if err != nil {
+		return nil, Validator{}, err
+	}
+	return body, responseValidator(resp, body), nil
+}
+
+// failTile 记录失败瓦片
+func (task *Task) failTile(t maptile.Tile) {
+	task.ledger.Record(t, TileFailed)
+	task.tileSet.Lock()
+	task.tileSet.M[t] = true
+	task.tileSet.Unlock()
+}
+
 // tileFetcher 瓦片加载器
-func (task *Task) tileFetcher(mt maptile.Tile, url string) {
+func (task *Task) tileFetcher(mt maptile.Tile, layer *Layer) {
 	start := time.Now()
 	defer task.tileWG.Done() //结束该瓦片请求
 	defer func() {
 		<-task.workers //workers完成并清退
 	}()
 
-	prep := func(t maptile.Tile, url string) string {
-		url = strings.Replace(url, "{x}", strconv.Itoa(int(t.X)), -1)
-		url = strings.Replace(url, "{y}", strconv.Itoa(int(t.Y)), -1)
-		maxY := int(math.Pow(2, float64(t.Z))) - 1
-		url = strings.Replace(url, "{-y}", strconv.Itoa(maxY-int(t.Y)), -1)
-		url = strings.Replace(url, "{z}", strconv.Itoa(int(t.Z)), -1)
-		return url
-	}
-	tile := prep(mt, url)
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			// 自定义重定向的行为
-			return http.ErrUseLastResponse // 使用最后一个响应
-		},
-	}
-	req, err := http.NewRequest("GET", tile, nil)
-	if err != nil {
-		fmt.Println("创建请求失败:", err)
-		return
+	//skip模式下跳过已存在的瓦片
+	if task.mode == ModeSkip {
+		ok, err := task.store.Has(mt)
+		if err != nil {
+			log.Warnf("check %v tile in %s error ~ %s", mt, task.File, err)
+		}
+		if ok {
+			atomic.AddInt64(&task.skipped, 1)
+			task.ledger.Record(mt, TileDone)
+			return
+		}
 	}
 
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
-	req.Header.Set("Referer", "https://map.tianditu.gov.cn")
-	// req.Header.Set("Referer", "https://jiangsu.tianditu.gov.cn")
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("发送请求失败:", err)
-		return
+	//update模式下读取已有瓦片的校验信息, 用于条件请求
+	var old Validator
+	if vs, ok := task.store.(ValidatorStore); ok && task.mode == ModeUpdate {
+		var err error
+		old, err = vs.Validator(mt)
+		if err != nil {
+			log.Warnf("read %v tile validator error ~ %s", mt, err)
+		}
 	}
-	defer resp.Body.Close()
-	// resp, err := http.Get(tile)
-	// if err != nil {
-	// 	log.Errorf("fetch :%s error, details: %s ~", tile, err)
-	// 	return
-	// }
-	// defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		log.Errorf("fetch %v tile error, status code: %d ~", tile, resp.StatusCode)
-		return
+
+	tile := layer.Template().Expand(mt)
+	var body []byte
+	var valid Validator
+	notModified := false
+	for attempt := 0; ; attempt++ {
+		err := task.limiter.Wait(task.ctx, tile)
+		if err != nil {
+			//任务取消, 瓦片保持pending状态留待续传
+			return
+		}
+		body, valid, err = task.fetchTile(layer.Source, tile, old)
+		if err == ErrNotModified {
+			task.limiter.Feedback(tile, nil)
+			notModified = true
+			break
+		}
+		task.limiter.Feedback(tile, err)
+		if err == nil {
+			break
+		}
+		if attempt >= task.retry.Retries || !task.retry.Retryable(err) {
+			log.Errorf("fetch %v tile error after %d attempts ~ %s", tile, attempt+1, err)
+			task.failTile(mt)
+			return
+		}
+		wait := task.retry.Backoff(attempt, err)
+		log.Warnf("fetch %v tile error ~ %s, retry in %v", tile, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-task.ctx.Done():
+			//任务取消, 瓦片保持pending状态留待续传
+			return
+		}
 	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Errorf("read %v tile error ~ %s", mt, err)
+	//源站返回304或内容hash未变化, 保留已有瓦片
+	if notModified || old.Hash != "" && valid.Hash == old.Hash {
+		atomic.AddInt64(&task.unchanged, 1)
+		task.ledger.Record(mt, TileDone)
 		return
 	}
+	if reason := task.blank.Check(body, task.TileMap.Format); reason != "" {
+		log.Debugf("blank tile %v ~ %s", mt, reason)
+		task.blankSet.Lock()
+		task.blankSet.M[mt] = true
+		task.blankSet.Unlock()
+		if task.blank.Action == BlankDrop {
+			task.ledger.Record(mt, TileDone)
+			return
+		}
+	}
 	if len(body) == 0 {
 		log.Warnf("nil tile %v ~", mt)
+		//空瓦片无需保存, 视为完成
+		task.ledger.Record(mt, TileDone)
 		return //zero byte tiles n
 	}
+	//边界瓦片按轮廓裁剪, 按输出格式转码, 矢量瓦片裁剪及过滤
+	if task.mask != nil || task.encoder != nil || task.vector != nil {
+		var data []byte
+		var err error
+		switch {
+		case task.vector != nil:
+			data, err = task.vector.Process(mt, layer.Collection, body)
+		case task.mask != nil:
+			data, err = task.mask.Apply(mt, layer.Collection, body, task.encoder != nil)
+		default:
+			data, err = task.encoder.Encode(body)
+		}
+		if err != nil {
+			log.Errorf("process %v tile to %s error ~ %s", mt, task.format, err)
+			task.failTile(mt)
+			return
+		}
+		if len(data) == 0 {
+			//裁剪过滤后无要素或瓦片完全在轮廓外, 无需保存
+			task.ledger.Record(mt, TileDone)
+			return
+		}
+		body = data
+	}
 	// tiledata
 	td := Tile{
 		T: mt,
 		C: body,
 	}
+	//校验信息仅在update模式下保存
+	if task.mode == ModeUpdate {
+		td.V = valid
+	}
 
-	if task.TileMap.Format == PBF {
+	//源站未声明Content-Encoding直接返回的gzip数据无需再压缩
+	if task.TileMap.Format == PBF && !bytes.HasPrefix(body, gzipMagic) {
 		var buf bytes.Buffer
 		zw := gzip.NewWriter(&buf)
-		_, err = zw.Write(body)
+		_, err := zw.Write(body)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -307,7 +526,7 @@ func (task *Task) tileFetcher(mt maptile.Tile, url string) {
 	}
 
 	//enable savingpipe
-	if task.outformat == "mbtiles" {
+	if _, ok := task.store.(BatchStore); ok {
 		task.savingpipe <- td
 	} else {
 		// task.wg.Add(1)
@@ -318,8 +537,114 @@ func (task *Task) tileFetcher(mt maptile.Tile, url string) {
 	log.Infof("tile(z:%d, x:%d, y:%d), %dms , %.2f kb, %s ...\n", mt.Z, mt.X, mt.Y, cost, float32(len(body))/1024.0, tile)
 }
 
-// DownloadZoom 下载指定层级
-func (task *Task) downloadLayer(layer Layer) {
+// waitPlay 暂停中等待继续或取消
+func (task *Task) waitPlay() {
+	for {
+		select {
+		case <-task.play:
+			log.Infof("Task %s go on.", task.ID)
+			return
+		case <-task.pause:
+			//已暂停, 忽略
+		case <-task.ctx.Done():
+			log.Infof("Task %s got canceled.", task.ID)
+			return
+		}
+	}
+}
+
+// coverLayer 生成层级瓦片, 任务取消时停止并关闭tilelist
+func (task *Task) coverLayer(layer Layer, tilelist chan<- maptile.Tile) {
+	defer close(tilelist)
+	if layer.Tiles != nil {
+		for _, t := range layer.Tiles {
+			select {
+			case tilelist <- t:
+			case <-task.ctx.Done():
+				return
+			}
+		}
+		return
+	}
+	if layer.Ranges != nil && layer.cover == nil {
+		task.coverRanges(layer.Ranges, tilelist)
+		return
+	}
+	shape := layer.Collection
+	if layer.cover != nil {
+		shape = layer.cover.Shape
+	}
+	emit := func(t maptile.Tile) bool {
+		//边缘瓦片最后统一派发
+		if layer.cover != nil && layer.cover.Margin[t] {
+			return true
+		}
+		select {
+		case tilelist <- t:
+			return true
+		case <-task.ctx.Done():
+			return false
+		}
+	}
+	//任务取消时停止覆盖计算
+	for _, g := range shape {
+		if !coverTiles(g, maptile.Zoom(layer.Zoom), emit) {
+			return
+		}
+	}
+	if layer.cover == nil {
+		return
+	}
+	for t := range layer.cover.Margin {
+		select {
+		case tilelist <- t:
+		case <-task.ctx.Done():
+			return
+		}
+	}
+}
+
+// coverRanges 按行生成各范围内的瓦片, 已在之前范围中的瓦片跳过
+func (task *Task) coverRanges(ranges []TileRange, tilelist chan<- maptile.Tile) {
+	for i, r := range ranges {
+		for y := uint64(r.MinY); y <= uint64(r.MaxY); y++ {
+		next:
+			for x := uint64(r.MinX); x <= uint64(r.MaxX); x++ {
+				for _, o := range ranges[:i] {
+					if o.Contains(uint32(x), uint32(y)) {
+						continue next
+					}
+				}
+				select {
+				case tilelist <- maptile.New(uint32(x), uint32(y), r.Z):
+				case <-task.ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// DownloadZoom 下载指定层级, 续传时读取账本失败返回错误
+func (task *Task) downloadLayer(layer Layer) error {
+	//续传时跳过已完成的瓦片
+	done := make(maptile.Set)
+	if task.resume {
+		set, err := task.ledger.DoneSet(layer.Zoom)
+		if err != nil {
+			return fmt.Errorf("read ledger of zoom %d error: %s", layer.Zoom, err)
+		}
+		done = set
+	}
+	//外扩或简化的层级开始下载时计算覆盖范围, 按实际瓦片数修正总数, 该层结束后释放
+	if layer.Tiles == nil && (!layer.Buffer.IsZero() || !layer.Simplify.IsZero()) {
+		layer.cover = NewCoverage(layer.Collection, maptile.Zoom(layer.Zoom), layer.Buffer, layer.Simplify)
+		delta := layer.cover.Count - layer.Count
+		layer.Count = layer.cover.Count
+		task.Bar.SetTotal64(atomic.AddInt64(&task.Total, delta))
+		log.Infof("zoom: %d, tiles with buffer/simplify: %d ~", layer.Zoom, layer.Count)
+	}
+
 	bar := pb.New64(layer.Count).Prefix(fmt.Sprintf("Zoom %d : ", layer.Zoom)).Postfix("\n")
 	// bar.SetRefreshRate(time.Second)
 	bar.Start()
@@ -327,35 +652,62 @@ func (task *Task) downloadLayer(layer Layer) {
 
 	var tilelist = make(chan maptile.Tile, task.bufSize)
 
-	go tilecover.CollectionChannel(layer.Collection, maptile.Zoom(layer.Zoom), tilelist)
+	go task.coverLayer(layer, tilelist)
 
 	for tile := range tilelist {
 		// log.Infof(`fetching tile %v ~`, tile)
-		select {
-		case task.workers <- tile:
-			//设置请求发送间隔时间
-			time.Sleep(time.Duration(task.timeDelay) * time.Millisecond)
+		if done[tile] {
 			bar.Increment()
 			task.Bar.Increment()
-			task.tileWG.Add(1)
-			go task.tileFetcher(tile, layer.URL)
-		case <-task.abort:
-			log.Infof("Task %s got canceled.", task.ID)
-			close(tilelist)
-		case <-task.pause:
-			log.Infof("Task %s suspended.", task.ID)
+			atomic.AddInt64(&task.Current, 1)
+			continue
+		}
+		//暂停期间瓦片保留, 继续后再派发
+		for dispatched := false; !dispatched && !task.Aborted(); {
 			select {
-			case <-task.play:
-				log.Infof("Task %s go on.", task.ID)
-			case <-task.abort:
+			case task.workers <- tile:
+				task.ledger.Record(tile, TilePending)
+				//设置请求发送间隔时间
+				time.Sleep(time.Duration(task.timeDelay) * time.Millisecond)
+				bar.Increment()
+				task.Bar.Increment()
+				atomic.AddInt64(&task.Current, 1)
+				task.tileWG.Add(1)
+				go task.tileFetcher(tile, &layer)
+				dispatched = true
+			case <-task.ctx.Done():
 				log.Infof("Task %s got canceled.", task.ID)
-				close(tilelist)
+			case <-task.pause:
+				log.Infof("Task %s suspended.", task.ID)
+				atomic.StoreInt32(&task.state, TaskPaused)
+				task.waitPlay()
+				atomic.StoreInt32(&task.state, TaskRunning)
+			case <-task.play:
+				//未暂停, 忽略
 			}
 		}
+		if task.Aborted() {
+			break
+		}
 	}
 	//等待该层结束
 	task.tileWG.Wait()
 	bar.FinishPrint(fmt.Sprintf("Task %s Zoom %d finished ~", task.ID, layer.Zoom))
+	if n := task.blankCounts()[layer.Zoom]; n > 0 {
+		log.Infof("%d blank tiles at zoom %d ~", n, layer.Zoom)
+	}
+	return nil
+}
+
+// blankCounts 各级别空白瓦片数
+func (task *Task) blankCounts() map[int]int {
+	counts := make(map[int]int)
+	task.blankSet.RLock()
+	for t := range task.blankSet.M {
+		counts[int(t.Z)]++
+	}
+	task.blankSet.RUnlock()
+	return counts
 }
 
 // Download 开启下载任务
@@ -365,18 +717,94 @@ func (task *Task) Download() {
 	// task.Bar.SetRefreshRate(10 * time.Second)
 	// task.Bar.Format("<.- >")
 	task.Bar.Start()
-	if task.outformat == "mbtiles" {
-		task.SetupMBTileTables()
-	} else {
-		if task.File == "" {
-			outdir := viper.GetString("output.directory")
-			task.File = filepath.Join(outdir, fmt.Sprintf("%s-z%d-%d.%s", task.Name, task.Min, task.Max, task.ID))
+	err := task.setupStore()
+	if err != nil {
+		log.Errorf("setup %s %s error ~ %s", task.outformat, task.File, err)
+		atomic.StoreInt32(&task.state, TaskFailed)
+		return
+	}
+	err = task.setupLedger()
+	if err != nil {
+		log.Errorf("setup ledger of task %s error ~ %s", task.ID, err)
+		task.store.Close()
+		atomic.StoreInt32(&task.state, TaskFailed)
+		return
+	}
+	atomic.StoreInt32(&task.state, TaskRunning)
+	if _, ok := task.store.(BatchStore); ok {
+		for i := 0; i < task.savePipeSize; i++ {
+			task.saveWG.Add(1)
+			go task.savePipe()
 		}
-		os.MkdirAll(task.File, os.ModePerm)
 	}
-	go task.savePipe()
+	failed := false
 	for _, layer := range task.Layers {
-		task.downloadLayer(layer)
+		if task.Aborted() {
+			break
+		}
+		err = task.downloadLayer(layer)
+		if err != nil {
+			log.Errorf("task %s error ~ %s", task.ID, err)
+			failed = true
+			break
+		}
+	}
+	//等待保存管道结束
+	close(task.savingpipe)
+	task.saveWG.Wait()
+	//取消时保留PMTiles临时文件以便续传
+	if pm, ok := task.store.(*PMTilesStore); ok {
+		pm.KeepTemp = task.Aborted()
+	}
+	err = task.store.Close()
+	if err != nil {
+		log.Errorf("close %s error ~ %s", task.File, err)
+	}
+	err = task.ledger.Close()
+	if err != nil {
+		log.Errorf("close ledger of task %s error ~ %s", task.ID, err)
+	} else if !failed && !task.Aborted() && len(task.tileSet.M) == 0 {
+		//全部完成无需续传, 删除账本
+		os.Remove(task.ledger.File)
+	}
+	//输出失败瓦片列表, 可通过 -failed 参数重新下载
+	failedFile := task.File + ".failed"
+	os.Remove(failedFile)
+	if len(task.tileSet.M) > 0 {
+		err = writeTileList(failedFile, task.tileSet.M)
+		if err != nil {
+			log.Errorf("write failed tiles %s error ~ %s", failedFile, err)
+		} else {
+			log.Warnf("%d tiles failed, see %s ~", len(task.tileSet.M), failedFile)
+		}
+	}
+	//输出空白瓦片列表
+	blankFile := task.File + ".blank"
+	os.Remove(blankFile)
+	if len(task.blankSet.M) > 0 {
+		err = writeTileList(blankFile, task.blankSet.M)
+		if err != nil {
+			log.Errorf("write blank tiles %s error ~ %s", blankFile, err)
+		} else {
+			log.Infof("%d blank tiles (%s), see %s ~", len(task.blankSet.M), task.blank.Action, blankFile)
+		}
+	}
+	if task.skipped > 0 {
+		log.Infof("%d existing tiles skipped ~", task.skipped)
+	}
+	if task.unchanged > 0 {
+		log.Infof("%d tiles unchanged ~", task.unchanged)
+	}
+	if failed {
+		atomic.StoreInt32(&task.state, TaskFailed)
+		task.Bar.FinishPrint(fmt.Sprintf("Task %s failed, resume with -resume %s ~", task.ID, task.ID))
+		return
+	}
+	if task.Aborted() {
+		atomic.StoreInt32(&task.state, TaskAborted)
+		task.Bar.FinishPrint(fmt.Sprintf("Task %s aborted, resume with -resume %s ~", task.ID, task.ID))
+		return
 	}
+	atomic.StoreInt32(&task.state, TaskFinished)
 	task.Bar.FinishPrint(fmt.Sprintf("Task %s finished ~", task.ID))
 }
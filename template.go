@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// DefaultSubdomains {s}未配置子域名时的默认列表
+var DefaultSubdomains = []string{"a", "b", "c"}
+
+// rangeRe 匹配{a-c}、{0-7}形式的子域名范围, 两端同为小写字母或同为数字, 不与{z-1}等变量混淆
+var rangeRe = regexp.MustCompile(`\{([a-z])-([a-z])\}|\{([0-9])-([0-9])\}`)
+
+// zoomRe 匹配{z+1}、{z-1}形式的级别偏移
+var zoomRe = regexp.MustCompile(`\{z([+-]\d+)\}`)
+
+var roundRobin uint64
+
+// mercatorOrigin web墨卡托半周长
+const mercatorOrigin = 20037508.342789244
+
+// URLTemplate 瓦片地址模板, 支持以下变量:
+//
+//	{x} {y} {z} {-y}          行列号, TMS为真时{y}为TMS行号, {-y}为XYZ行号
+//	{z+1} {z-1}               级别偏移
+//	{s} {a-c} {0-7}           子域名轮换
+//	{quadkey}                 Bing四叉树编码
+//	{bbox} {bbox-epsg-3857}   WMS GetMap范围, EPSG:3857 minx,miny,maxx,maxy
+//	{TileMatrix} {TileRow} {TileCol}  WMTS, TileMatrix为MatrixPrefix加级别
+type URLTemplate struct {
+	URL          string
+	Subdomains   []string
+	Balance      string
+	MatrixPrefix string
+	TMS          bool //瓦片源为TMS行序
+}
+
+// Expand 生成瓦片地址
+func (tpl URLTemplate) Expand(t maptile.Tile) string {
+	url := expandSubdomain(tpl.URL, t, tpl.Subdomains, tpl.Balance)
+	y, flipY := int(t.Y), int(math.Pow(2, float64(t.Z)))-1-int(t.Y)
+	if tpl.TMS {
+		y, flipY = flipY, y
+	}
+	url = zoomRe.ReplaceAllStringFunc(url, func(m string) string {
+		offset, _ := strconv.Atoi(zoomRe.FindStringSubmatch(m)[1])
+		return strconv.Itoa(int(t.Z) + offset)
+	})
+	if strings.Contains(url, "{quadkey}") {
+		url = strings.Replace(url, "{quadkey}", quadkey(t), -1)
+	}
+	if strings.Contains(url, "{bbox") {
+		bbox := mercatorBBox(t)
+		url = strings.Replace(url, "{bbox}", bbox, -1)
+		url = strings.Replace(url, "{bbox-epsg-3857}", bbox, -1)
+	}
+	r := strings.NewReplacer(
+		"{x}", strconv.Itoa(int(t.X)),
+		"{y}", strconv.Itoa(y),
+		"{-y}", strconv.Itoa(flipY),
+		"{z}", strconv.Itoa(int(t.Z)),
+		"{TileMatrix}", tpl.MatrixPrefix+strconv.Itoa(int(t.Z)),
+		"{TileRow}", strconv.Itoa(int(t.Y)),
+		"{TileCol}", strconv.Itoa(int(t.X)),
+	)
+	return r.Replace(url)
+}
+
+// quadkey Bing瓦片四叉树编码
+func quadkey(t maptile.Tile) string {
+	key := make([]byte, 0, t.Z)
+	for i := t.Z; i > 0; i-- {
+		digit := byte('0')
+		mask := uint32(1) << (i - 1)
+		if t.X&mask != 0 {
+			digit++
+		}
+		if t.Y&mask != 0 {
+			digit += 2
+		}
+		key = append(key, digit)
+	}
+	return string(key)
+}
+
+// mercatorBBox 瓦片EPSG:3857范围
+func mercatorBBox(t maptile.Tile) string {
+	size := 2 * mercatorOrigin / math.Pow(2, float64(t.Z))
+	minx := -mercatorOrigin + float64(t.X)*size
+	maxy := mercatorOrigin - float64(t.Y)*size
+	return fmt.Sprintf("%f,%f,%f,%f", minx, maxy-size, minx+size, maxy)
+}
+
+// pickSubdomain 选择子域名, hash方式下同一瓦片总是对应同一主机以利于缓存
+func pickSubdomain(t maptile.Tile, list []string, balance string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	if balance == "roundrobin" {
+		n := atomic.AddUint64(&roundRobin, 1)
+		return list[n%uint64(len(list))]
+	}
+	return list[(uint64(t.X)+uint64(t.Y))%uint64(len(list))]
+}
+
+// expandSubdomain 替换URL中的{s}及{a-c}、{0-7}范围
+func expandSubdomain(url string, t maptile.Tile, subdomains []string, balance string) string {
+	if strings.Contains(url, "{s}") {
+		if len(subdomains) == 0 {
+			subdomains = DefaultSubdomains
+		}
+		url = strings.Replace(url, "{s}", pickSubdomain(t, subdomains, balance), -1)
+	}
+	return rangeRe.ReplaceAllStringFunc(url, func(m string) string {
+		from, to := m[1], m[3]
+		//{x-y}等以行列号、级别为端点的不是子域名范围
+		if from > to || strings.ContainsAny(m, "xyz") {
+			return m
+		}
+		var list []string
+		for c := from; c <= to; c++ {
+			list = append(list, string(c))
+		}
+		return pickSubdomain(t, list, balance)
+	})
+}
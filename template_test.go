@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestURLTemplateExpand(t *testing.T) {
+	tile := maptile.New(6, 2, 3)
+	cases := []struct {
+		name string
+		tpl  URLTemplate
+		want string
+	}{
+		{
+			name: "xyz",
+			tpl:  URLTemplate{URL: "https://t/{z}/{x}/{y}.png"},
+			want: "https://t/3/6/2.png",
+		},
+		{
+			name: "xyz -y",
+			tpl:  URLTemplate{URL: "https://t/{z}/{x}/{-y}.png"},
+			want: "https://t/3/6/5.png",
+		},
+		{
+			name: "tms y",
+			tpl:  URLTemplate{URL: "https://t/{z}/{x}/{y}.png", TMS: true},
+			want: "https://t/3/6/5.png",
+		},
+		{
+			name: "tms -y",
+			tpl:  URLTemplate{URL: "https://t/{z}/{x}/{-y}.png", TMS: true},
+			want: "https://t/3/6/2.png",
+		},
+		{
+			name: "quadkey",
+			tpl:  URLTemplate{URL: "https://t/{quadkey}.jpeg"},
+			want: "https://t/130.jpeg",
+		},
+		{
+			name: "zoom offset",
+			tpl:  URLTemplate{URL: "https://t/{z+1}/{z-1}/{z}"},
+			want: "https://t/4/2/3",
+		},
+		{
+			name: "wmts",
+			tpl: URLTemplate{
+				URL:          "https://t/wmts?TileMatrix={TileMatrix}&TileRow={TileRow}&TileCol={TileCol}",
+				MatrixPrefix: "EPSG:3857:",
+			},
+			want: "https://t/wmts?TileMatrix=EPSG:3857:3&TileRow=2&TileCol=6",
+		},
+		{
+			//WMTS行号总是xyz行序
+			name: "wmts tms",
+			tpl:  URLTemplate{URL: "https://t/{TileMatrix}/{TileRow}/{TileCol}", TMS: true},
+			want: "https://t/3/2/6",
+		},
+		{
+			name: "subdomains",
+			tpl:  URLTemplate{URL: "https://{s}.t/{z}/{x}/{y}", Subdomains: []string{"t0", "t1", "t2", "t3"}},
+			want: "https://t0.t/3/6/2",
+		},
+		{
+			name: "default subdomains",
+			tpl:  URLTemplate{URL: "https://{s}.t/{z}/{x}/{y}"},
+			want: "https://c.t/3/6/2",
+		},
+		{
+			name: "letter range",
+			tpl:  URLTemplate{URL: "https://{a-c}.t/{z}/{x}/{y}"},
+			want: "https://c.t/3/6/2",
+		},
+		{
+			name: "digit range",
+			tpl:  URLTemplate{URL: "https://mt{0-7}.t/{z}/{x}/{y}"},
+			want: "https://mt0.t/3/6/2",
+		},
+		{
+			name: "zoom offset is not a range",
+			tpl:  URLTemplate{URL: "https://{a-c}.t/{z-1}/{z-3}/{x}/{y}"},
+			want: "https://c.t/2/0/6/2",
+		},
+		{
+			name: "placeholders are not a range",
+			tpl:  URLTemplate{URL: "https://t/{x-y}/{a-z}/{1-z}/{z}"},
+			want: "https://t/{x-y}/{a-z}/{1-z}/3",
+		},
+	}
+	for _, c := range cases {
+		if got := c.tpl.Expand(tile); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestURLTemplateQuadkey(t *testing.T) {
+	//Bing文档中的示例
+	if got := quadkey(maptile.New(3, 5, 3)); got != "213" {
+		t.Errorf("quadkey of 3/3/5 = %s, want 213", got)
+	}
+	if got := quadkey(maptile.New(0, 0, 0)); got != "" {
+		t.Errorf("quadkey of 0/0/0 = %q, want empty", got)
+	}
+}
+
+func TestURLTemplateBBox(t *testing.T) {
+	tpl := URLTemplate{URL: "BBOX={bbox}&b={bbox-epsg-3857}"}
+	want := "BBOX=-20037508.342789,0.000000,0.000000,20037508.342789&b=-20037508.342789,0.000000,0.000000,20037508.342789"
+	if got := tpl.Expand(maptile.New(0, 0, 1)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	want = "BBOX=-20037508.342789,-20037508.342789,20037508.342789,20037508.342789&b=-20037508.342789,-20037508.342789,20037508.342789,20037508.342789"
+	if got := tpl.Expand(maptile.New(0, 0, 0)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestURLTemplateHashBalance(t *testing.T) {
+	tpl := URLTemplate{URL: "https://{s}.t/{z}/{x}/{y}", Subdomains: []string{"t0", "t1", "t2", "t3"}, Balance: "hash"}
+	//同一瓦片总是同一主机, 与请求顺序无关
+	for _, tile := range []maptile.Tile{maptile.New(6, 2, 3), maptile.New(7, 2, 3), maptile.New(100, 200, 10)} {
+		first := tpl.Expand(tile)
+		for i := 0; i < 10; i++ {
+			tpl.Expand(maptile.New(uint32(i), 0, 3))
+			if got := tpl.Expand(tile); got != first {
+				t.Fatalf("hash balance of %v changed: %s, %s", tile, first, got)
+			}
+		}
+	}
+	//(x+y)%n
+	if got := tpl.Expand(maptile.New(7, 2, 3)); got != "https://t1.t/3/7/2" {
+		t.Errorf("got %s, want https://t1.t/3/7/2", got)
+	}
+}
+
+func TestURLTemplateRoundRobin(t *testing.T) {
+	tpl := URLTemplate{URL: "https://{s}.t/{z}/{x}/{y}", Subdomains: []string{"t0", "t1"}, Balance: "roundrobin"}
+	tile := maptile.New(6, 2, 3)
+	if a, b := tpl.Expand(tile), tpl.Expand(tile); a == b {
+		t.Errorf("roundrobin should rotate subdomains, got %s twice", a)
+	}
+}
@@ -22,6 +22,7 @@ const ZoomMax = 20
 type Tile struct {
 	T maptile.Tile
 	C []byte
+	V Validator //源站校验信息, 支持的存储随瓦片保存
 }
 
 func (tile Tile) flipY() uint32 {
@@ -37,10 +38,31 @@ type Set struct {
 
 //Layer 级别&瓦片数
 type Layer struct {
-	URL        string
-	Zoom       int
-	Count      int64
-	Collection orb.Collection
+	URL          string
+	Zoom         int
+	Count        int64
+	Collection   orb.Collection
+	Tiles        maptile.Tiles //指定瓦片列表, 不为空时不再计算覆盖
+	Ranges       []TileRange   //该级别的瓦片行列号范围, 不为空时按范围生成瓦片
+	Source       *Source       //为空时使用TileMap的配置
+	Subdomains   []string      //为空时使用TileMap的配置
+	Balance      string
+	MatrixPrefix string
+	Schema       string   //xyz或tms, 为空时使用TileMap的配置
+	Buffer       Distance //覆盖范围外扩距离
+	Simplify     Distance //计算覆盖前的简化容差
+	cover        *Coverage
+}
+
+// Template 瓦片地址模板
+func (layer *Layer) Template() URLTemplate {
+	return URLTemplate{
+		URL:          layer.URL,
+		Subdomains:   layer.Subdomains,
+		Balance:      layer.Balance,
+		MatrixPrefix: layer.MatrixPrefix,
+		TMS:          layer.Schema == "tms",
+	}
 }
 
 // Constants representing TileFormat types
@@ -3,9 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"os"
-	"path/filepath"
 	"sync"
 
 	"github.com/paulmach/orb"
@@ -15,27 +13,6 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func saveToMBTile(tile Tile, db *sql.DB) error {
-	_, err := db.Exec("insert into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?);", tile.T.Z, tile.T.X, tile.flipY(), tile.C)
-	// _, err := db.Exec("insert or ignore into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?);", tile.T.Z, tile.T.X, tile.flipY(), tile.C)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func saveToFiles(tile Tile, task *Task) error {
-	dir := filepath.Join(task.File, fmt.Sprintf(`%d`, tile.T.Z), fmt.Sprintf(`%d`, tile.T.X))
-	os.MkdirAll(dir, os.ModePerm)
-	fileName := filepath.Join(dir, fmt.Sprintf(`%d.%s`, tile.T.Y, task.TileMap.Format))
-	err := os.WriteFile(fileName, tile.C, os.ModePerm)
-	if err != nil {
-		return err
-	}
-	log.Println(fileName)
-	return nil
-}
-
 func optimizeConnection(db *sql.DB) error {
 	// _, err := db.Exec("PRAGMA synchronous=0")
 	// if err != nil {
@@ -116,25 +93,6 @@ func loadFeatureCollection(path string) *geojson.FeatureCollection {
 	return fc
 }
 
-func loadCollection(path string) orb.Collection {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		log.Fatalf("unable to read file: %v", err)
-	}
-
-	fc, err := geojson.UnmarshalFeatureCollection(data)
-	if err != nil {
-		log.Fatalf("unable to unmarshal feature: %v", err)
-	}
-
-	var collection orb.Collection
-	for _, f := range fc.Features {
-		collection = append(collection, f.Geometry)
-	}
-
-	return collection
-}
-
 // output gets called if there is a test failure for debugging.
 func output(name string, r *geojson.FeatureCollection) {
 	f := loadFeature("./data/" + name + ".geojson")
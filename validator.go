@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// ErrNotModified 条件请求返回304, 瓦片未变化
+var ErrNotModified = errors.New("not modified")
+
+// Validator 瓦片校验信息, 源站的ETag、Last-Modified及内容hash
+type Validator struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+}
+
+// ValidatorStore 保存瓦片校验信息的存储, 校验信息随Tile.V写入
+// update模式下据此发送条件请求, 跳过未变化的瓦片
+type ValidatorStore interface {
+	Validator(t maptile.Tile) (Validator, error)
+}
+
+// Empty 是否无校验信息
+func (v Validator) Empty() bool {
+	return v.ETag == "" && v.LastModified == "" && v.Hash == ""
+}
+
+// SetConditional 设置条件请求头
+func (v Validator) SetConditional(req *http.Request) {
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+}
+
+// responseValidator 响应的校验信息
+func responseValidator(resp *http.Response, body []byte) Validator {
+	return Validator{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Hash:         fmt.Sprintf("%x", md5.Sum(body)),
+	}
+}
+
+// setupValidatorTable 创建校验信息表, 行列号与瓦片表一致
+func setupValidatorTable(db *sql.DB) error {
+	_, err := db.Exec("create table if not exists tile_validators (zoom_level integer, tile_column integer, tile_row integer, etag text, last_modified text, hash text, primary key (zoom_level, tile_column, tile_row));")
+	return err
+}
+
+// prepareValidator 预编译校验信息写入语句
+func prepareValidator(db *sql.DB) (*sql.Stmt, error) {
+	return db.Prepare("insert or replace into tile_validators (zoom_level, tile_column, tile_row, etag, last_modified, hash) values (?, ?, ?, ?, ?, ?);")
+}
+
+// saveValidator 写入校验信息, 无校验信息时跳过
+func saveValidator(stmt *sql.Stmt, z maptile.Zoom, x, y uint32, v Validator) error {
+	if v.Empty() {
+		return nil
+	}
+	_, err := stmt.Exec(z, x, y, v.ETag, v.LastModified, v.Hash)
+	return err
+}
+
+// queryValidator 读取校验信息, 无记录时返回空
+func queryValidator(db *sql.DB, z maptile.Zoom, x, y uint32) (Validator, error) {
+	var v Validator
+	err := db.QueryRow("select etag, last_modified, hash from tile_validators where zoom_level = ? and tile_column = ? and tile_row = ?;", z, x, y).Scan(&v.ETag, &v.LastModified, &v.Hash)
+	if err == sql.ErrNoRows {
+		return v, nil
+	}
+	return v, err
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// vectorBuffer 裁剪时保留的瓦片缓冲区, 瓦片边长的倍数
+const vectorBuffer = 0.1
+
+// VectorProcessor 矢量瓦片处理, 要素按图层轮廓裁剪, 按图层及属性过滤, 处理后重新编码
+type VectorProcessor struct {
+	Clip    bool
+	Layers  map[string]bool         //保留的图层, 为空时保留全部
+	Drop    map[string]bool         //删除的图层
+	Filters map[string][]propFilter //各图层要素需满足的属性条件
+}
+
+// propFilter 属性条件, key=a|b、key!=a|b、key(存在)、!key(不存在)
+type propFilter struct {
+	Key    string
+	Values map[string]bool
+	Not    bool
+}
+
+// NewVectorProcessor 从配置创建矢量瓦片处理, 未配置或源不是矢量瓦片时返回nil
+func NewVectorProcessor(src string) *VectorProcessor {
+	vp := &VectorProcessor{
+		Clip:    viper.GetBool("output.vector.clip"),
+		Layers:  make(map[string]bool),
+		Drop:    make(map[string]bool),
+		Filters: make(map[string][]propFilter),
+	}
+	for _, name := range viper.GetStringSlice("output.vector.layers") {
+		vp.Layers[name] = true
+	}
+	for _, name := range viper.GetStringSlice("output.vector.droplayers") {
+		vp.Drop[name] = true
+	}
+	for name, conds := range viper.GetStringMapStringSlice("output.vector.filter") {
+		for _, cond := range conds {
+			vp.Filters[name] = append(vp.Filters[name], parsePropFilter(cond))
+		}
+	}
+	if !vp.Clip && len(vp.Layers) == 0 && len(vp.Drop) == 0 && len(vp.Filters) == 0 {
+		return nil
+	}
+	if src != PBF {
+		log.Warnf("vector options only apply to %s tiles, ignored for %s ~", PBF, src)
+		return nil
+	}
+	return vp
+}
+
+// parsePropFilter 解析属性条件
+func parsePropFilter(cond string) propFilter {
+	cond = strings.TrimSpace(cond)
+	f := propFilter{}
+	i := strings.Index(cond, "=")
+	if i < 0 {
+		f.Not = strings.HasPrefix(cond, "!")
+		f.Key = strings.TrimPrefix(cond, "!")
+		return f
+	}
+	f.Key = cond[:i]
+	if strings.HasSuffix(f.Key, "!") {
+		f.Not = true
+		f.Key = strings.TrimSuffix(f.Key, "!")
+	}
+	f.Key = strings.TrimSpace(f.Key)
+	f.Values = make(map[string]bool)
+	for _, v := range strings.Split(cond[i+1:], "|") {
+		f.Values[strings.TrimSpace(v)] = true
+	}
+	return f
+}
+
+// Match 属性是否满足条件, 数值与where相同按数值比较
+func (f propFilter) Match(props geojson.Properties) bool {
+	v, ok := props[f.Key]
+	if f.Values == nil || !ok {
+		return ok != f.Not
+	}
+	for value := range f.Values {
+		if compareValue(v, value) == 0 {
+			return !f.Not
+		}
+	}
+	return f.Not
+}
+
+// Process 解码瓦片并处理, 未做任何改动时返回原数据, 处理后无要素时返回空
+func (vp *VectorProcessor) Process(t maptile.Tile, c orb.Collection, body []byte) ([]byte, error) {
+	var layers mvt.Layers
+	var err error
+	if bytes.HasPrefix(body, gzipMagic) {
+		layers, err = mvt.UnmarshalGzipped(body)
+	} else {
+		layers, err = mvt.Unmarshal(body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode mvt error: %s", err)
+	}
+	changed := false
+	kept := layers[:0]
+	for _, l := range layers {
+		if vp.Drop[l.Name] || len(vp.Layers) > 0 && !vp.Layers[l.Name] {
+			changed = true
+			continue
+		}
+		var clips []orb.Polygon
+		if vp.Clip {
+			//保留瓦片缓冲区内的要素
+			var found bool
+			extent := int(l.Extent)
+			clips, found = tilePolygons(c, t, extent, extent, vectorBuffer)
+			if !found || coversExtent(clips, extent, vectorBuffer) {
+				clips = nil
+			} else if len(clips) == 0 {
+				changed = true
+				continue
+			}
+		}
+		features := l.Features[:0]
+		for _, f := range l.Features {
+			if !vp.match(l.Name, f.Properties) {
+				changed = true
+				continue
+			}
+			if len(clips) > 0 {
+				//空几何无法判断内外, 直接删除
+				p, ok := firstPoint(f.Geometry)
+				if !ok {
+					changed = true
+					continue
+				}
+				if nearBoundary(f.Geometry.Bound(), clips) {
+					f.Geometry = roundGeometry(clipGeometry(f.Geometry, clips))
+					changed = true
+					if f.Geometry == nil {
+						continue
+					}
+				} else if !clipPoint(p, clips) {
+					changed = true
+					continue
+				}
+			}
+			features = append(features, f)
+		}
+		l.Features = features
+		if len(features) > 0 {
+			kept = append(kept, l)
+		}
+	}
+	if !changed {
+		return body, nil
+	}
+	if len(kept) == 0 {
+		return nil, nil
+	}
+	return mvt.Marshal(kept)
+}
+
+// match 要素是否满足图层的全部属性条件
+func (vp *VectorProcessor) match(layer string, props geojson.Properties) bool {
+	for _, f := range vp.Filters[layer] {
+		if !f.Match(props) {
+			return false
+		}
+	}
+	return true
+}
+
+// coversExtent 裁剪面是否覆盖整个瓦片及缓冲区
+func coversExtent(polygons []orb.Polygon, extent int, buffer float64) bool {
+	if len(polygons) != 1 || len(polygons[0]) != 1 {
+		return false
+	}
+	size := (1 + 2*buffer) * float64(extent)
+	return math.Abs(ringArea(polygons[0][0])) >= size*size*(1-1e-9)
+}
+
+// clipGeometry 几何裁剪到裁剪面内, 全部在面外时返回nil
+func clipGeometry(g orb.Geometry, clips []orb.Polygon) orb.Geometry {
+	switch g := g.(type) {
+	case orb.Point:
+		if clipPoint(g, clips) {
+			return g
+		}
+	case orb.MultiPoint:
+		var mp orb.MultiPoint
+		for _, p := range g {
+			if clipPoint(p, clips) {
+				mp = append(mp, p)
+			}
+		}
+		if len(mp) > 0 {
+			return mp
+		}
+	case orb.LineString:
+		return clipGeometry(orb.MultiLineString{g}, clips)
+	case orb.MultiLineString:
+		var mls orb.MultiLineString
+		for _, ls := range g {
+			mls = append(mls, clipLineString(ls, clips)...)
+		}
+		if len(mls) == 1 {
+			return mls[0]
+		}
+		if len(mls) > 0 {
+			return mls
+		}
+	case orb.Polygon:
+		return clipGeometry(orb.MultiPolygon{g}, clips)
+	case orb.MultiPolygon:
+		var mp orb.MultiPolygon
+		for _, p := range g {
+			mp = append(mp, clipPolygon(p, clips)...)
+		}
+		if len(mp) == 1 {
+			return mp[0]
+		}
+		if len(mp) > 0 {
+			return mp
+		}
+	}
+	return nil
+}
+
+// roundGeometry 坐标取整到瓦片网格, 去除重复点及退化的线和环
+func roundGeometry(g orb.Geometry) orb.Geometry {
+	round := func(ps []orb.Point) []orb.Point {
+		out := make([]orb.Point, 0, len(ps))
+		for _, p := range ps {
+			p = orb.Point{math.Round(p[0]), math.Round(p[1])}
+			if len(out) == 0 || out[len(out)-1] != p {
+				out = append(out, p)
+			}
+		}
+		return out
+	}
+	line := func(ls orb.LineString) orb.LineString {
+		ls = round(ls)
+		if len(ls) < 2 {
+			return nil
+		}
+		return ls
+	}
+	polygon := func(p orb.Polygon) orb.Polygon {
+		var out orb.Polygon
+		for i, r := range p {
+			r = round(r)
+			if len(r) < 4 || ringArea(r) == 0 {
+				if i == 0 {
+					return nil
+				}
+				continue
+			}
+			out = append(out, r)
+		}
+		return out
+	}
+	switch g := g.(type) {
+	case orb.Point:
+		return orb.Point{math.Round(g[0]), math.Round(g[1])}
+	case orb.MultiPoint:
+		return orb.MultiPoint(round(g))
+	case orb.LineString:
+		if ls := line(g); ls != nil {
+			return ls
+		}
+	case orb.MultiLineString:
+		var mls orb.MultiLineString
+		for _, ls := range g {
+			if ls = line(ls); ls != nil {
+				mls = append(mls, ls)
+			}
+		}
+		if len(mls) > 0 {
+			return mls
+		}
+	case orb.Polygon:
+		if p := polygon(g); p != nil {
+			return p
+		}
+	case orb.MultiPolygon:
+		var mp orb.MultiPolygon
+		for _, p := range g {
+			if p = polygon(p); p != nil {
+				mp = append(mp, p)
+			}
+		}
+		if len(mp) > 0 {
+			return mp
+		}
+	}
+	return nil
+}
+
+// firstPoint 几何的第一个点, 用于判断整体在裁剪面内外, 空几何时ok为false
+func firstPoint(g orb.Geometry) (p orb.Point, ok bool) {
+	switch g := g.(type) {
+	case nil:
+		return p, false
+	case orb.Point:
+		return g, true
+	case orb.MultiPoint:
+		if len(g) > 0 {
+			return g[0], true
+		}
+	case orb.LineString:
+		if len(g) > 0 {
+			return g[0], true
+		}
+	case orb.MultiLineString:
+		for _, ls := range g {
+			if len(ls) > 0 {
+				return ls[0], true
+			}
+		}
+	case orb.Polygon:
+		if len(g) > 0 && len(g[0]) > 0 {
+			return g[0][0], true
+		}
+	case orb.MultiPolygon:
+		for _, poly := range g {
+			if len(poly) > 0 && len(poly[0]) > 0 {
+				return poly[0][0], true
+			}
+		}
+	default:
+		b := g.Bound()
+		return b.Center(), !b.IsEmpty()
+	}
+	return p, false
+}
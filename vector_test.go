@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestPropFilterMatch(t *testing.T) {
+	props := geojson.Properties{"pop": 1e6, "name": "a", "rank": 2.5, "capital": true}
+	cases := []struct {
+		cond string
+		want bool
+	}{
+		{"pop=1000000", true},
+		{"pop=1e6", true},
+		{"pop=999999|1000000", true},
+		{"pop!=1000000", false},
+		{"pop=10", false},
+		{"rank=2.50", true},
+		{"name=a|b", true},
+		{"name = b", false},
+		{"name!=b", true},
+		{"capital=true", true},
+		{"name", true},
+		{"!name", false},
+		{"kind", false},
+		{"!kind", true},
+		{"kind=a", false},
+		{"kind!=a", true},
+	}
+	for _, c := range cases {
+		if got := parsePropFilter(c.cond).Match(props); got != c.want {
+			t.Errorf("%s: match = %v, want %v", c.cond, got, c.want)
+		}
+	}
+}
+
+func TestFirstPoint(t *testing.T) {
+	cases := []struct {
+		name string
+		g    orb.Geometry
+		p    orb.Point
+		ok   bool
+	}{
+		{"point", orb.Point{1, 2}, orb.Point{1, 2}, true},
+		{"multipoint", orb.MultiPoint{{1, 2}, {3, 4}}, orb.Point{1, 2}, true},
+		{"line", orb.LineString{{1, 2}, {3, 4}}, orb.Point{1, 2}, true},
+		{"multiline skips empty", orb.MultiLineString{{}, {{3, 4}, {5, 6}}}, orb.Point{3, 4}, true},
+		{"polygon", rect(1, 2, 3, 4), orb.Point{1, 2}, true},
+		{"multipolygon skips empty", orb.MultiPolygon{{}, rect(1, 2, 3, 4)}, orb.Point{1, 2}, true},
+		{"collection", orb.Collection{orb.Point{1, 2}}, orb.Point{1, 2}, true},
+		{"nil", nil, orb.Point{}, false},
+		{"empty multipoint", orb.MultiPoint{}, orb.Point{}, false},
+		{"empty line", orb.LineString{}, orb.Point{}, false},
+		{"empty multiline", orb.MultiLineString{{}}, orb.Point{}, false},
+		{"empty polygon", orb.Polygon{}, orb.Point{}, false},
+		{"empty ring", orb.Polygon{{}}, orb.Point{}, false},
+		{"empty multipolygon", orb.MultiPolygon{{{}}}, orb.Point{}, false},
+		{"empty collection", orb.Collection{}, orb.Point{}, false},
+	}
+	for _, c := range cases {
+		if p, ok := firstPoint(c.g); p != c.p || ok != c.ok {
+			t.Errorf("%s: first point = %v, %v, want %v, %v", c.name, p, ok, c.p, c.ok)
+		}
+	}
+}
+
+// vectorTile 编码矢量瓦片
+func vectorTile(t *testing.T, layers ...*mvt.Layer) []byte {
+	t.Helper()
+	for _, l := range layers {
+		l.Version, l.Extent = 2, 4096
+	}
+	body, err := mvt.Marshal(mvt.Layers(layers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func feature(g orb.Geometry, props geojson.Properties) *geojson.Feature {
+	f := geojson.NewFeature(g)
+	f.Properties = props
+	return f
+}
+
+func TestVectorProcess(t *testing.T) {
+	tile := maptile.New(3370, 1654, 12)
+	b := tile.Bound()
+	mid := (b.Min[0] + b.Max[0]) / 2
+	//轮廓为瓦片左半部分, 像素范围x 0-2048
+	mask := orb.Collection{square(orb.Bound{Min: b.Min, Max: orb.Point{mid, b.Max[1]}})}
+
+	body := vectorTile(t,
+		&mvt.Layer{Name: "poi", Features: []*geojson.Feature{
+			feature(orb.Point{1000, 1000}, geojson.Properties{"pop": 1e6, "name": "in"}),
+			feature(orb.Point{3000, 1000}, geojson.Properties{"pop": 1e6, "name": "out"}),
+			feature(orb.Point{1000, 2000}, geojson.Properties{"pop": 5, "name": "small"}),
+			feature(orb.MultiPoint{{1, 1}, {1, 1}}, geojson.Properties{"pop": 1e6, "name": "empty"}),
+		}},
+		&mvt.Layer{Name: "roads", Features: []*geojson.Feature{
+			feature(orb.LineString{{500, 500}, {3500, 500}}, geojson.Properties{"class": "primary"}),
+		}},
+		&mvt.Layer{Name: "water", Features: []*geojson.Feature{
+			feature(rect(100, 100, 200, 200), geojson.Properties{}),
+		}},
+	)
+	//源站瓦片中的空MultiPoint: 几何命令MoveTo的点数改为0
+	empty := bytes.Replace(body, []byte{0x22, 5, 17, 2, 2, 0, 0}, []byte{0x22, 5, 1, 2, 2, 0, 0}, 1)
+	if bytes.Equal(empty, body) {
+		t.Fatal("multipoint geometry not found in encoded tile")
+	}
+	layers, err := mvt.Unmarshal(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := layers[0].Features[3].Geometry.(orb.MultiPoint); !ok || len(g) != 0 {
+		t.Fatalf("decoded geometry = %#v, want an empty multipoint", layers[0].Features[3].Geometry)
+	}
+
+	vp := &VectorProcessor{
+		Clip:    true,
+		Drop:    map[string]bool{"water": true},
+		Filters: map[string][]propFilter{"poi": {parsePropFilter("pop=1000000")}},
+	}
+	gzipped, err := gzipBytes(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range [][]byte{empty, gzipped} {
+		out, err := vp.Process(tile, mask, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers, err := mvt.Unmarshal(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(layers) != 2 || layers[0].Name != "poi" || layers[1].Name != "roads" {
+			t.Fatalf("layers = %v, want poi and roads", layers)
+		}
+		poi := layers[0].Features
+		if len(poi) != 1 || poi[0].Properties["name"] != "in" || poi[0].Geometry != (orb.Point{1000, 1000}) {
+			t.Errorf("poi features = %v, want only the one inside", poi)
+		}
+		road := layers[1].Features
+		want := orb.LineString{{500, 500}, {2048, 500}}
+		if len(road) != 1 || !orb.Equal(road[0].Geometry, want) {
+			t.Errorf("roads = %v, want %v", road, want)
+		}
+	}
+
+	//未做改动时返回原数据, 全部删除时返回空
+	keep := &VectorProcessor{Filters: map[string][]propFilter{"roads": {parsePropFilter("class")}}}
+	if out, err := keep.Process(tile, mask, body); err != nil || !bytes.Equal(out, body) {
+		t.Errorf("unchanged tile = %d bytes, %v, want the source tile", len(out), err)
+	}
+	none := &VectorProcessor{Layers: map[string]bool{"buildings": true}}
+	if out, err := none.Process(tile, mask, body); err != nil || out != nil {
+		t.Errorf("tile without kept layers = %d bytes, %v, want nil", len(out), err)
+	}
+	if _, err := none.Process(tile, mask, []byte("not a tile")); err == nil {
+		t.Error("invalid tile decoded without error")
+	}
+}
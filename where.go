@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// whereFunc 要素属性筛选条件
+type whereFunc func(props geojson.Properties) bool
+
+// parseWhere 解析类SQL的属性条件, 如"adcode = 320100"、"name LIKE '南京%' AND level IN ('city', 'district')"
+// 支持=、!=、<>、<、<=、>、>=、[NOT] IN、[NOT] LIKE、IS [NOT] NULL, 以AND、OR、NOT及括号组合;
+// 字符串用单引号, 含空格的字段名用双引号, 两边均为数值时按数值比较
+func parseWhere(s string) (whereFunc, error) {
+	p := &whereParser{}
+	if err := p.tokenize(s); err != nil {
+		return nil, err
+	}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in where", p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+type whereToken struct {
+	text  string
+	kind  byte //i标识符, s字符串, n数值, o运算符及括号
+	upper string
+}
+
+type whereParser struct {
+	tokens []whereToken
+	pos    int
+}
+
+// tokenize 切分词法单元
+func (p *whereParser) tokenize(s string) error {
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(rs); j++ {
+				if rs[j] == c {
+					if j+1 < len(rs) && rs[j+1] == c { //引号重复表示转义
+						b.WriteRune(c)
+						j++
+						continue
+					}
+					break
+				}
+				b.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return fmt.Errorf("unterminated quote in where")
+			}
+			kind := byte('s')
+			if c == '"' {
+				kind = 'i'
+			}
+			p.tokens = append(p.tokens, whereToken{text: b.String(), kind: kind})
+			i = j + 1
+		case strings.ContainsRune("=<>!(),", c):
+			op := string(c)
+			if i+1 < len(rs) && (c == '<' || c == '>' || c == '!') && (rs[i+1] == '=' || c == '<' && rs[i+1] == '>') {
+				op += string(rs[i+1])
+			}
+			if op == "!" {
+				return fmt.Errorf("unexpected ! in where")
+			}
+			p.tokens = append(p.tokens, whereToken{text: op, kind: 'o'})
+			i += len([]rune(op))
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) && !strings.ContainsRune("=<>!(),'\"", rs[j]) {
+				j++
+			}
+			text := string(rs[i:j])
+			kind := byte('i')
+			if _, err := strconv.ParseFloat(text, 64); err == nil {
+				kind = 'n'
+			}
+			p.tokens = append(p.tokens, whereToken{text: text, kind: kind, upper: strings.ToUpper(text)})
+			i = j
+		}
+	}
+	return nil
+}
+
+func (p *whereParser) peek() whereToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return whereToken{}
+}
+
+// keyword 下一个单元为关键字kw时跳过并返回true
+func (p *whereParser) keyword(kw string) bool {
+	t := p.peek()
+	if t.kind == 'i' && t.upper == kw {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// op 下一个单元为运算符op时跳过并返回true
+func (p *whereParser) op(op string) bool {
+	t := p.peek()
+	if t.kind == 'o' && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *whereParser) or() (whereFunc, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(props geojson.Properties) bool { return l(props) || right(props) }
+	}
+	return left, nil
+}
+
+func (p *whereParser) and() (whereFunc, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(props geojson.Properties) bool { return l(props) && right(props) }
+	}
+	return left, nil
+}
+
+func (p *whereParser) not() (whereFunc, error) {
+	if p.keyword("NOT") {
+		f, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(props geojson.Properties) bool { return !f(props) }, nil
+	}
+	if p.op("(") {
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.op(")") {
+			return nil, fmt.Errorf("missing ) in where")
+		}
+		return f, nil
+	}
+	return p.condition()
+}
+
+// condition 单个字段条件
+func (p *whereParser) condition() (whereFunc, error) {
+	t := p.peek()
+	if t.kind != 'i' {
+		return nil, fmt.Errorf("expect a field name in where, got %q", t.text)
+	}
+	p.pos++
+	field := t.text
+	switch {
+	case p.keyword("IS"):
+		not := p.keyword("NOT")
+		if !p.keyword("NULL") {
+			return nil, fmt.Errorf("expect NULL after IS in where")
+		}
+		return func(props geojson.Properties) bool {
+			_, ok := property(props, field)
+			return ok == not
+		}, nil
+	case p.keyword("NOT"):
+		f, err := p.setOrLike(field)
+		if err != nil {
+			return nil, err
+		}
+		return func(props geojson.Properties) bool {
+			_, ok := property(props, field)
+			return ok && !f(props)
+		}, nil
+	case p.peek().kind == 'i' && (p.peek().upper == "IN" || p.peek().upper == "LIKE"):
+		return p.setOrLike(field)
+	}
+	op := p.peek()
+	switch op.text {
+	case "=", "!=", "<>", "<", "<=", ">", ">=":
+		p.pos++
+	default:
+		return nil, fmt.Errorf("expect an operator after %s in where", field)
+	}
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return func(props geojson.Properties) bool {
+		v, ok := property(props, field)
+		if !ok {
+			return false
+		}
+		c := compareValue(v, value)
+		switch op.text {
+		case "=":
+			return c == 0
+		case "!=", "<>":
+			return c != 0
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		default:
+			return c >= 0
+		}
+	}, nil
+}
+
+// setOrLike IN列表或LIKE匹配
+func (p *whereParser) setOrLike(field string) (whereFunc, error) {
+	if p.keyword("LIKE") {
+		pattern, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		re, err := likePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return func(props geojson.Properties) bool {
+			v, ok := property(props, field)
+			return ok && re.MatchString(fmt.Sprint(v))
+		}, nil
+	}
+	if !p.keyword("IN") || !p.op("(") {
+		return nil, fmt.Errorf("expect IN (...) or LIKE after %s in where", field)
+	}
+	var values []string
+	for {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		if p.op(")") {
+			break
+		}
+		if !p.op(",") {
+			return nil, fmt.Errorf("expect , or ) in IN list of where")
+		}
+	}
+	return func(props geojson.Properties) bool {
+		v, ok := property(props, field)
+		if !ok {
+			return false
+		}
+		for _, value := range values {
+			if compareValue(v, value) == 0 {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// value 字符串或数值, 不带引号的单词也作为字符串
+func (p *whereParser) value() (string, error) {
+	t := p.peek()
+	if p.pos >= len(p.tokens) || t.kind == 'o' {
+		return "", fmt.Errorf("expect a value in where, got %q", t.text)
+	}
+	p.pos++
+	return t.text, nil
+}
+
+// likePattern LIKE模式转为正则, %匹配任意字符, _匹配单个字符, 不区分大小写
+func likePattern(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	for _, c := range pattern {
+		switch c {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// property 取属性值, 字段名先精确匹配再忽略大小写匹配, 值为null视为不存在
+func property(props geojson.Properties, field string) (interface{}, bool) {
+	v, ok := props[field]
+	if !ok {
+		for k, pv := range props {
+			if strings.EqualFold(k, field) {
+				v, ok = pv, true
+				break
+			}
+		}
+	}
+	return v, ok && v != nil
+}
+
+// compareValue 属性值与条件值比较, 两者均为数值时按数值比较, 否则按字符串比较
+func compareValue(v interface{}, value string) int {
+	s := fmt.Sprint(v)
+	switch n := v.(type) {
+	case float64:
+		s = strconv.FormatFloat(n, 'f', -1, 64)
+	case bool:
+		if strings.EqualFold(value, "true") || strings.EqualFold(value, "false") {
+			value = strings.ToLower(value)
+		}
+	}
+	a, err1 := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	b, err2 := strconv.ParseFloat(value, 64)
+	if err1 == nil && err2 == nil {
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(s, value)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestParseWhere(t *testing.T) {
+	props := geojson.Properties{
+		"name":      "南京市",
+		"adcode":    320100.0,
+		"level":     "city",
+		"code":      "9",
+		"Area Name": "it's",
+		"capital":   true,
+		"empty":     nil,
+	}
+	cases := []struct {
+		where string
+		want  bool
+	}{
+		{"adcode = 320100", true},
+		{"adcode = '320100'", true},
+		{"adcode = 320100.0", true},
+		{"adcode <> 320100", false},
+		{"adcode != 1", true},
+		{"adcode > 32000", true},
+		{"adcode >= 320100", true},
+		{"adcode < 4", false},
+		{"adcode <= 4", false},
+		//两边均为数值时按数值比较, 否则按字符串比较
+		{"code < '10'", true},
+		{"code = '09'", true},
+		{"level > 'b'", true},
+		{"level < 'b'", false},
+		{"level = 'City'", false},
+		{"capital = true", true},
+		{"capital = TRUE", true},
+
+		{"name = '南京市'", true},
+		{"name LIKE '南京%'", true},
+		{"name LIKE '%京_'", true},
+		{"name LIKE '京%'", false},
+		{"level LIKE 'CI%'", true},
+		{"name NOT LIKE '苏%'", true},
+		{"level IN ('city', 'district')", true},
+		{"adcode IN (320000, 320100)", true},
+		{"level NOT IN ('city')", false},
+		{"level NOT IN ('province')", true},
+
+		//字段名先精确匹配再忽略大小写匹配, 关键字不区分大小写
+		{"ADCODE = 320100", true},
+		{"name like '南京%' and level in ('city')", true},
+		{`"Area Name" = 'it''s'`, true},
+		{`"area name" = 'it''s'`, true},
+
+		//null及不存在的字段
+		{"empty IS NULL", true},
+		{"missing IS NULL", true},
+		{"name IS NULL", false},
+		{"name IS NOT NULL", true},
+		{"empty = 1", false},
+		{"missing != 1", false},
+		{"missing NOT IN ('a')", false},
+		{"missing NOT LIKE 'a%'", false},
+
+		//NOT高于AND, AND高于OR
+		{"level = 'city' OR level = 'x' AND adcode = 1", true},
+		{"(level = 'city' OR level = 'x') AND adcode = 1", false},
+		{"level = 'x' AND adcode = 1 OR name = '南京市'", true},
+		{"NOT level = 'city' OR adcode = 320100", true},
+		{"NOT (level = 'city' OR adcode = 1)", false},
+		{"NOT level = 'x' AND NOT adcode = 1", true},
+		{"((adcode = 320100))", true},
+	}
+	for _, c := range cases {
+		f, err := parseWhere(c.where)
+		if err != nil {
+			t.Errorf("%s: %s", c.where, err)
+			continue
+		}
+		if got := f(props); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.where, got, c.want)
+		}
+	}
+}
+
+func TestParseWhereErrors(t *testing.T) {
+	cases := []struct {
+		where string
+		err   string
+	}{
+		{"", "expect a field name"},
+		{"adcode =", "expect a value"},
+		{"adcode 320100", "expect an operator"},
+		{"name = '南京", "unterminated quote"},
+		{`"name = 1`, "unterminated quote"},
+		{"(adcode = 1", "missing )"},
+		{"adcode = 1)", "unexpected"},
+		{"adcode = 1 name = 2", "unexpected"},
+		{"adcode = 1 AND", "expect a field name"},
+		{"level IN ('a', 'b'", "expect , or )"},
+		{"level IN 'a'", "expect IN (...) or LIKE"},
+		{"level NOT = 'a'", "expect IN (...) or LIKE"},
+		{"level IS 'a'", "expect NULL"},
+		{"!level", "unexpected !"},
+		{"= 1", "expect a field name"},
+	}
+	for _, c := range cases {
+		_, err := parseWhere(c.where)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: error %v, want %q", c.where, err, c.err)
+		}
+	}
+}